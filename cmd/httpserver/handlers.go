@@ -14,6 +14,7 @@ import (
 	"github.com/bailey4770/httpfromtcp/internal/headers"
 	"github.com/bailey4770/httpfromtcp/internal/request"
 	"github.com/bailey4770/httpfromtcp/internal/response"
+	"github.com/bailey4770/httpfromtcp/internal/server"
 )
 
 func yourProblemHandler(w *response.Writer, req *request.Request) {
@@ -65,12 +66,25 @@ func defaultHandler(w *response.Writer, req *request.Request) {
 }
 
 func chunkedHandler(w *response.Writer, req *request.Request) {
-	subdomain := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-	url := "https://httpbin.org" + subdomain
+	// The raw path keeps the client's percent-encoding intact for upstream
+	url := "https://httpbin.org" + strings.TrimPrefix(req.Target.RawPath, "/httpbin")
+	if req.Target.RawQuery != "" {
+		url += "?" + req.Target.RawQuery
+	}
+
+	// Stop pulling from upstream as soon as our own client goes away
+	upstreamReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		log.Printf("Error: could not build request for %v: %v", url, err)
+		_ = response.Write(w, response.StatusBadRequest, response.GetDefaultHeaders(), []byte(response.StatusText(response.StatusBadRequest)))
+		return
+	}
 
-	resp, err := http.Get(url)
+	resp, err := http.DefaultClient.Do(upstreamReq)
 	if err != nil {
 		log.Printf("Error: could not GET from %v: %v", url, err)
+		headers := response.GetDefaultHeaders()
+		_ = response.Write(w, response.StatusBadGateway, headers, []byte(response.StatusText(response.StatusBadGateway)))
 		return
 	}
 	defer func() { _ = resp.Body.Close() }()
@@ -128,13 +142,5 @@ func chunkedHandler(w *response.Writer, req *request.Request) {
 }
 
 func videoHandler(w *response.Writer, req *request.Request) {
-	data, err := os.ReadFile("./assets/vim.mp4")
-	if err != nil {
-		log.Printf("Error: could not read video file: %v", err)
-	}
-
-	headers := response.GetDefaultHeaders()
-	headers.Override("content-type", "video/mp4")
-
-	response.Write(w, response.StatusOK, headers, data)
+	server.ServeFile(w, req, os.DirFS("assets"), "vim.mp4")
 }
@@ -1,48 +1,53 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 
-	"github.com/bailey4770/httpfromtcp/internal/request"
 	"github.com/bailey4770/httpfromtcp/internal/server"
 )
 
-const port = 8080
+const (
+	port            = 8080
+	shutdownTimeout = 10 * time.Second
+)
 
 func main() {
-	server, err := server.Serve(port, router)
+	server, err := server.Serve(port, newRouter().Route)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer func() { _ = server.Close() }()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
-	log.Println("Server gracefully stopped")
-}
+	log.Println("Shutting down, waiting for active connections to finish")
 
-func router(req *request.Request) server.Handler {
-	if req.RequestLine.RequestTarget == "/yourproblem" {
-		return yourProblemHandler
-	}
-
-	if req.RequestLine.RequestTarget == "/myproblem" {
-		return myProblemHandler
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		return chunkedHandler
-	}
-
-	if req.RequestLine.RequestTarget == "/video" {
-		return videoHandler
+	forceClosed, err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Error: shutdown deadline passed, force-closed %d connections: %v", forceClosed, err)
+		return
 	}
+	log.Println("Server gracefully stopped")
+}
 
-	return defaultHandler
+func newRouter() *server.Mux {
+	mux := server.NewMux()
+	mux.Use(server.Logger(nil), server.Recover, server.RequestID, server.Compress(0))
+
+	mux.Handle("/yourproblem", yourProblemHandler)
+	mux.Handle("/myproblem", myProblemHandler)
+	mux.Handle("/httpbin", chunkedHandler)
+	mux.Handle("/httpbin/{path...}", chunkedHandler)
+	mux.Handle("GET /video", videoHandler)
+	mux.NotFound = defaultHandler
+	return mux
 }
@@ -33,7 +33,7 @@ func main() {
 		fmt.Printf("- Version: %v\n", req.RequestLine.HTTPVersion)
 
 		fmt.Println("Headers:")
-		for k, v := range req.Headers {
+		for k, v := range req.Headers.All() {
 			fmt.Printf("- %s: %s\n", k, v)
 		}
 
@@ -2,9 +2,13 @@ module github.com/bailey4770/httpfromtcp
 
 go 1.25.5
 
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/stretchr/testify v1.11.1
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.11.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -5,37 +5,69 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"iter"
 	"net/textproto"
+	"slices"
 	"strings"
 )
 
 const crlf = "\r\n"
 
-type Headers map[string]string
+// Field is a single field line, with its name cased as it was received or added.
+type Field struct {
+	Name  string
+	Value string
+}
 
-func NewHeaders() Headers {
-	return make(Headers)
+// Headers holds field lines in the order they were received or added. Names
+// are matched case-insensitively, and repeated names are kept as separate lines
+// so fields like Set-Cookie survive intact.
+type Headers struct {
+	fields []Field
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	cleaned := strings.TrimSpace(strings.ToLower(key))
+func NewHeaders() *Headers {
+	return &Headers{}
+}
 
-	val, ok := h[cleaned]
-	return val, ok
+// Get returns every value stored under key joined with ", ", which is how
+// repeated fields combine for everything except Set-Cookie.
+func (h *Headers) Get(key string) (string, bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ", "), true
 }
 
-func (h Headers) Set(key, value string) {
-	if existingValue, ok := h.Get(key); ok {
-		combinedValue := existingValue + ", " + strings.TrimSpace(value)
-		h[strings.ToLower(key)] = combinedValue
-	} else {
-		h[strings.ToLower(key)] = strings.TrimSpace(value)
+// Values returns the value of every field line named key, in order.
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if equalNames(f.Name, key) {
+			values = append(values, f.Value)
+		}
 	}
+	return values
+}
+
+// Add appends a new field line, keeping any existing lines with the same name.
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, Field{
+		Name:  strings.TrimSpace(key),
+		Value: strings.TrimSpace(value),
+	})
+}
+
+// Set adds value to key. Kept alongside Add for existing callers; reading the
+// field back with Get still yields the comma-joined values.
+func (h *Headers) Set(key, value string) {
+	h.Add(key, value)
 }
 
-func (h Headers) SetTrailers(values ...string) {
+func (h *Headers) SetTrailers(values ...string) {
 	for _, v := range values {
-		h.Set("trailer", v)
+		h.Set("Trailer", v)
 	}
 }
 
@@ -43,15 +75,69 @@ func CanonicalHeaderKey(k string) string {
 	return textproto.CanonicalMIMEHeaderKey(k)
 }
 
-func (h Headers) Override(key, value string) {
-	h[strings.ToLower(key)] = strings.TrimSpace(value)
+// Override replaces every line named key with a single one holding value. The
+// replacement takes the position of the first existing line.
+func (h *Headers) Override(key, value string) {
+	value = strings.TrimSpace(value)
+
+	for i, f := range h.fields {
+		if equalNames(f.Name, key) {
+			h.fields[i].Value = value
+			h.fields = append(h.fields[:i+1], deleteNamed(h.fields[i+1:], key)...)
+			return
+		}
+	}
+	h.Add(key, value)
+}
+
+// Del removes every line named key.
+func (h *Headers) Del(key string) {
+	h.fields = deleteNamed(h.fields, key)
+}
+
+func (h *Headers) Remove(key string) {
+	h.Del(key)
+}
+
+// Len returns the number of field lines.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// All iterates over every field line in order, which is also the order they are
+// serialized in.
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, f := range h.fields {
+			if !yield(f.Name, f.Value) {
+				return
+			}
+		}
+	}
+}
+
+// Clone returns a copy that can be changed without affecting h.
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: slices.Clone(h.fields)}
 }
 
-func (h Headers) Remove(key string) {
-	delete(h, strings.ToLower(key))
+// HasToken reports whether the comma-separated list stored under key contains
+// token, compared case-insensitively. Useful for fields like Connection.
+func (h *Headers) HasToken(key, token string) bool {
+	val, ok := h.Get(key)
+	if !ok {
+		return false
+	}
+
+	for part := range strings.SplitSeq(val, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	idx := bytes.Index(data, []byte(crlf))
 
 	switch idx {
@@ -68,7 +154,9 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 0, false, errors.New("could not find delimiter : in header line")
 	}
 
-	if key[len(key)-1] == ' ' {
+	if key == "" {
+		return 0, false, errors.New("empty field name")
+	} else if key[len(key)-1] == ' ' {
 		return 0, false, errors.New("cannot have space between key and colon")
 	} else if !isValidFieldName(key) {
 		return 0, false, fmt.Errorf("invalid field name. %s does not pass valid field name checks", key)
@@ -78,6 +166,17 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	return idx + len(crlf), false, nil
 }
 
+func equalNames(a, b string) bool {
+	return strings.EqualFold(a, strings.TrimSpace(b))
+}
+
+// deleteNamed filters fields in place, dropping lines named key.
+func deleteNamed(fields []Field, key string) []Field {
+	return slices.DeleteFunc(fields, func(f Field) bool {
+		return equalNames(f.Name, key)
+	})
+}
+
 func isValidFieldName(s string) bool {
 	if len(s) == 0 {
 		return false
@@ -7,6 +7,12 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// get returns the combined value stored under key, or "" if there is none.
+func get(h *Headers, key string) string {
+	val, _ := h.Get(key)
+	return val
+}
+
 func TestParseHeaders(t *testing.T) {
 	t.Run("Valid single header", func(t *testing.T) {
 		headers := NewHeaders()
@@ -14,7 +20,7 @@ func TestParseHeaders(t *testing.T) {
 		n, done, err := headers.Parse(data)
 		require.NoError(t, err)
 		require.NotNil(t, headers)
-		assert.Equal(t, "localhost:42069", headers["host"])
+		assert.Equal(t, "localhost:42069", get(headers, "host"))
 		assert.Equal(t, len(data)-2, n)
 		assert.False(t, done)
 	})
@@ -25,20 +31,20 @@ func TestParseHeaders(t *testing.T) {
 		n, done, err := headers.Parse(data)
 		require.NoError(t, err)
 		require.NotNil(t, headers)
-		assert.Equal(t, "localhost:42069", headers["host"])
+		assert.Equal(t, "localhost:42069", get(headers, "host"))
 		assert.Equal(t, len(data)-2, n)
 		assert.False(t, done)
 	})
 
 	t.Run("Valid new header with existing headers", func(t *testing.T) {
 		headers := NewHeaders()
-		headers["host"] = "localhost:42069"
+		headers.Set("host", "localhost:42069")
 		data := []byte("Content-Type: json \r\n\r\n")
 		n, done, err := headers.Parse(data)
 		require.NoError(t, err)
 		require.NotNil(t, headers)
-		assert.Equal(t, "localhost:42069", headers["host"])
-		assert.Equal(t, "json", headers["content-type"])
+		assert.Equal(t, "localhost:42069", get(headers, "host"))
+		assert.Equal(t, "json", get(headers, "content-type"))
 		assert.Equal(t, len(data)-2, n)
 		assert.False(t, done)
 	})
@@ -59,19 +65,19 @@ func TestParseHeaders(t *testing.T) {
 		n, done, err := headers.Parse(data)
 		require.NoError(t, err)
 		require.NotNil(t, headers)
-		assert.Equal(t, "json", headers["content-type"])
+		assert.Equal(t, "json", get(headers, "content-type"))
 		assert.Equal(t, len(data)-2, n)
 		assert.False(t, done)
 	})
 
 	t.Run("Valid add values to existing header", func(t *testing.T) {
 		headers := NewHeaders()
-		headers["set-person"] = "bailey"
+		headers.Set("set-person", "bailey")
 		data := []byte("Set-Person: testing \r\n\r\n")
 		n, done, err := headers.Parse(data)
 		require.NoError(t, err)
 		require.NotNil(t, headers)
-		assert.Equal(t, "bailey, testing", headers["set-person"])
+		assert.Equal(t, "bailey, testing", get(headers, "set-person"))
 		assert.Equal(t, len(data)-2, n)
 		assert.False(t, done)
 	})
@@ -93,4 +99,97 @@ func TestParseHeaders(t *testing.T) {
 		assert.Equal(t, 0, n)
 		assert.False(t, done)
 	})
+
+	t.Run("Empty field name", func(t *testing.T) {
+		for _, line := range []string{": x", ":", "   : x"} {
+			headers := NewHeaders()
+			assert.NotPanics(t, func() {
+				n, done, err := headers.Parse([]byte(line + "\r\n\r\n"))
+				require.Error(t, err, line)
+				assert.Equal(t, 0, n)
+				assert.False(t, done)
+			}, line)
+		}
+	})
+}
+
+func TestHasToken(t *testing.T) {
+	t.Run("Token in list", func(t *testing.T) {
+		headers := NewHeaders()
+		headers.Set("Connection", "keep-alive, Upgrade")
+		assert.True(t, headers.HasToken("connection", "upgrade"))
+		assert.True(t, headers.HasToken("Connection", "Keep-Alive"))
+	})
+
+	t.Run("Token missing", func(t *testing.T) {
+		headers := NewHeaders()
+		headers.Set("Connection", "keep-alive")
+		assert.False(t, headers.HasToken("Connection", "close"))
+		assert.False(t, headers.HasToken("Upgrade", "websocket"))
+	})
+}
+
+func TestMultipleValues(t *testing.T) {
+	t.Run("Repeated fields kept as separate lines", func(t *testing.T) {
+		headers := NewHeaders()
+		data := []byte("Set-Cookie: a=1; Path=/\r\nSet-Cookie: b=2, c=3\r\n\r\n")
+		n, _, err := headers.Parse(data)
+		require.NoError(t, err)
+		_, _, err = headers.Parse(data[n:])
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"a=1; Path=/", "b=2, c=3"}, headers.Values("set-cookie"))
+		assert.Equal(t, 2, headers.Len())
+	})
+
+	t.Run("Order and casing preserved", func(t *testing.T) {
+		headers := NewHeaders()
+		headers.Add("X-Second", "2")
+		headers.Add("content-type", "text/plain")
+		headers.Add("X-First", "1")
+		headers.Add("x-second", "3")
+
+		var lines []string
+		for k, v := range headers.All() {
+			lines = append(lines, k+": "+v)
+		}
+		assert.Equal(t, []string{"X-Second: 2", "content-type: text/plain", "X-First: 1", "x-second: 3"}, lines)
+	})
+
+	t.Run("Override replaces every line in place", func(t *testing.T) {
+		headers := NewHeaders()
+		headers.Add("Accept", "text/html")
+		headers.Add("Host", "localhost")
+		headers.Add("accept", "*/*")
+		headers.Override("ACCEPT", "application/json")
+
+		assert.Equal(t, []string{"application/json"}, headers.Values("Accept"))
+		var names []string
+		for k := range headers.All() {
+			names = append(names, k)
+		}
+		assert.Equal(t, []string{"Accept", "Host"}, names)
+	})
+
+	t.Run("Del removes every line", func(t *testing.T) {
+		headers := NewHeaders()
+		headers.Add("Set-Cookie", "a=1")
+		headers.Add("Host", "localhost")
+		headers.Add("Set-Cookie", "b=2")
+		headers.Del("set-cookie")
+
+		_, ok := headers.Get("Set-Cookie")
+		assert.False(t, ok)
+		assert.Equal(t, 1, headers.Len())
+	})
+
+	t.Run("Clone is independent", func(t *testing.T) {
+		headers := NewHeaders()
+		headers.Add("Host", "localhost")
+		clone := headers.Clone()
+		clone.Override("Host", "example.com")
+
+		assert.Equal(t, "localhost", get(headers, "Host"))
+		assert.Equal(t, "example.com", get(clone, "Host"))
+	})
 }
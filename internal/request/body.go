@@ -0,0 +1,96 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// maxDrainBytes bounds how much unread body Close will discard to keep the
+// connection usable. Anything bigger is cheaper to handle by closing it.
+const maxDrainBytes = 256 << 10
+
+var (
+	// ErrBodyReadAfterClose is returned when reading a body that was closed.
+	ErrBodyReadAfterClose = errors.New("read on closed request body")
+	// ErrBodyNotConsumed is returned by Close when too much of the body was left
+	// unread to discard it, meaning the connection cannot carry another request.
+	ErrBodyNotConsumed = errors.New("request body was not fully read")
+)
+
+// body streams a request body from the Reader it arrived on, decoding the
+// Content-Length or chunked framing as it goes.
+type body struct {
+	reader *Reader
+	req    *Request
+	err    error
+	closed bool
+	// closeErr is what the first Close returned, so later ones report it too
+	closeErr error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if len(b.req.decoded) == 0 && b.req.state != doneParsing && b.err == nil {
+		b.err = b.reader.parseUntil(b.req, func() bool {
+			return len(b.req.decoded) > 0 || b.req.state == doneParsing
+		})
+	}
+
+	if len(b.req.decoded) > 0 {
+		n := copy(p, b.req.decoded)
+		b.req.decoded = b.req.decoded[n:]
+		return n, nil
+	}
+
+	if b.err != nil {
+		return 0, b.err
+	}
+	return 0, io.EOF
+}
+
+// Close discards whatever is left of the body so the next request can be read
+// from the connection. It returns the error that stopped the body from being
+// read, or ErrBodyNotConsumed if more than maxDrainBytes were left. Closing
+// it again returns the same error, so the server still sees it when a handler
+// closed the body first.
+func (b *body) Close() error {
+	if b.closed {
+		return b.closeErr
+	}
+
+	_, err := io.CopyN(io.Discard, b, maxDrainBytes+1)
+	b.closed = true
+
+	switch {
+	case err == nil:
+		b.closeErr = ErrBodyNotConsumed
+	case errors.Is(err, io.EOF):
+	default:
+		b.closeErr = err
+	}
+	return b.closeErr
+}
+
+// BufferBody reads the rest of the body into Body, for handlers that want it
+// all at once. BodyReader is replaced with a reader over Body, so the body can
+// still be read as a stream afterwards.
+func (r *Request) BufferBody() error {
+	data, err := io.ReadAll(r.BodyReader)
+	if err != nil {
+		return err
+	}
+	if err := r.BodyReader.Close(); err != nil {
+		return err
+	}
+
+	r.Body = append(r.Body, data...)
+	r.BodyReader = io.NopCloser(bytes.NewReader(r.Body))
+	return nil
+}
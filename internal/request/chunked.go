@@ -0,0 +1,135 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxChunkSizeLineBytes bounds a chunk-size line including its extensions
+const maxChunkSizeLineBytes = 4096
+
+// ErrUnsupportedTransferEncoding is returned for a request whose
+// Transfer-Encoding is anything but chunked on its own. It maps to 501 Not
+// Implemented.
+var ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+
+// checkTransferEncoding makes sure a request with Transfer-Encoding can be
+// framed. Only chunked is supported, as no other codings are decoded, and
+// Content-Length alongside it is rejected since the two disagreeing is the
+// basis of request smuggling.
+func (r *Request) checkTransferEncoding() error {
+	if _, ok := r.Headers.Get("Content-Length"); ok {
+		return errors.New("request has both Transfer-Encoding and Content-Length")
+	}
+
+	te, _ := r.Headers.Get("Transfer-Encoding")
+	if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+		return fmt.Errorf("%w: %q", ErrUnsupportedTransferEncoding, te)
+	}
+	return nil
+}
+
+// parseChunkSize parses a chunk-size line, moving on to the chunk data or, for
+// the terminating zero-size chunk, to the trailer section.
+func (r *Request) parseChunkSize(data []byte) (int, error) {
+	idx := bytes.Index(data, []byte(crlf))
+	if idx > maxChunkSizeLineBytes || (idx == -1 && len(data) > maxChunkSizeLineBytes) {
+		return 0, errors.New("chunk size line too long")
+	}
+	if idx == -1 {
+		return 0, nil
+	}
+
+	size, err := chunkSizeFromString(string(data[:idx]))
+	if err != nil {
+		return 0, err
+	}
+
+	if r.bodyBytesRead+size > r.limits.maxBodyBytes() {
+		return 0, fmt.Errorf("%w: chunked body exceeds %d bytes", ErrBodyTooLarge, r.limits.maxBodyBytes())
+	}
+
+	if size == 0 {
+		r.state = parsingTrailers
+	} else {
+		r.chunkRemaining = size
+		r.state = parsingChunkData
+	}
+	return idx + len(crlf), nil
+}
+
+// parseChunkData appends chunk data to the body, then consumes the CRLF that
+// must follow it.
+func (r *Request) parseChunkData(data []byte) (int, error) {
+	if r.chunkRemaining > 0 {
+		numBytesParsed := int(min(int64(len(data)), r.chunkRemaining))
+		r.decoded = append(r.decoded, data[:numBytesParsed]...)
+		r.chunkRemaining -= int64(numBytesParsed)
+		r.bodyBytesRead += int64(numBytesParsed)
+		return numBytesParsed, nil
+	}
+
+	if len(data) < len(crlf) {
+		return 0, nil
+	}
+	if !bytes.HasPrefix(data, []byte(crlf)) {
+		return 0, errors.New("chunk data is longer than its chunk size")
+	}
+
+	r.state = parsingChunkSize
+	return len(crlf), nil
+}
+
+// parseTrailers parses the trailer section after the last chunk. It shares the
+// header limits since trailer fields are just more field lines.
+func (r *Request) parseTrailers(data []byte) (int, error) {
+	numBytesParsed, done, err := r.Trailers.Parse(data)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := r.checkFieldLimits(numBytesParsed, done, len(data)); err != nil {
+		return 0, err
+	}
+
+	if done {
+		r.state = doneParsing
+	}
+
+	return numBytesParsed, nil
+}
+
+// chunkSizeFromString parses chunk-size [ chunk-ext ]. Extensions are checked
+// for shape but otherwise ignored, as RFC 9112 allows.
+func chunkSizeFromString(line string) (int64, error) {
+	sizeStr, extensions, _ := strings.Cut(line, ";")
+	sizeStr = strings.TrimRight(sizeStr, " \t")
+
+	if sizeStr == "" || len(sizeStr) > 15 {
+		return 0, fmt.Errorf("invalid chunk size %q", sizeStr)
+	}
+	for _, c := range sizeStr {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return 0, fmt.Errorf("invalid chunk size %q", sizeStr)
+		}
+	}
+
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size %q: %w", sizeStr, err)
+	}
+
+	if extensions != "" {
+		for ext := range strings.SplitSeq(extensions, ";") {
+			name, _, _ := strings.Cut(ext, "=")
+			if strings.TrimSpace(name) == "" {
+				return 0, fmt.Errorf("invalid chunk extension %q", ext)
+			}
+		}
+	}
+
+	return size, nil
+}
@@ -0,0 +1,186 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"sync"
+)
+
+// ErrNotForm is returned by ParseMultipartForm and MultipartReader when the
+// request body is not multipart/form-data.
+var ErrNotForm = errors.New("request body is not multipart/form-data")
+
+// ParseForm fills Form with the query parameters and, for POST, PUT and PATCH
+// requests with an application/x-www-form-urlencoded body, the body's
+// parameters, which are also put in PostForm. Body values come first in Form.
+// The body is read in full, so BodyReader is left at EOF. Calling it again
+// does nothing but return the first call's error, if any.
+func (r *Request) ParseForm() error {
+	if r.formErr != nil {
+		return r.formErr
+	}
+
+	if r.PostForm == nil {
+		postForm := url.Values{}
+		if hasFormBody(r.RequestLine.Method) && r.mediaType() == "application/x-www-form-urlencoded" {
+			values, err := readForm(r.BodyReader)
+			if err != nil {
+				r.formErr = err
+				return err
+			}
+			postForm = values
+		}
+		r.PostForm = postForm
+	}
+
+	if r.Form == nil {
+		r.Form = url.Values{}
+		for key, values := range r.PostForm {
+			r.Form[key] = append(r.Form[key], values...)
+		}
+		for key, values := range r.Query() {
+			r.Form[key] = append(r.Form[key], values...)
+		}
+	}
+	return nil
+}
+
+func readForm(body io.Reader) (url.Values, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseQuery(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid form body: %w", err)
+	}
+	return values, nil
+}
+
+// FormValue returns the first value for key from the query or form body, or ""
+// if there is none. It parses the form first if needed, using the default
+// MultipartLimits for multipart bodies, and ignores parse errors; call
+// ParseForm or ParseMultipartForm to see them.
+func (r *Request) FormValue(key string) string {
+	if r.Form == nil {
+		if r.mediaType() == "multipart/form-data" {
+			_ = r.ParseMultipartForm(MultipartLimits{})
+		} else {
+			_ = r.ParseForm()
+		}
+	}
+	return r.Form.Get(key)
+}
+
+// ParseMultipartForm reads a multipart/form-data body into MultipartForm. Its
+// values are added to Form and PostForm, after ParseForm has filled them from
+// the query. File parts bigger than limits.MaxMemory are spooled to temporary
+// files, which RemoveMultipartFiles deletes. Once the body has been read,
+// calling it again does nothing but return the first call's error, if any.
+func (r *Request) ParseMultipartForm(limits MultipartLimits) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if r.multipartErr != nil {
+		return r.multipartErr
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	mr.Limits = limits
+
+	form, err := mr.ReadForm()
+	if err != nil {
+		r.multipartErr = err
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		_ = form.RemoveAll()
+		r.multipartErr = err
+		return err
+	}
+	for key, values := range form.Value {
+		r.PostForm[key] = append(r.PostForm[key], values...)
+		r.Form[key] = append(append([]string(nil), values...), r.Form[key]...)
+	}
+	r.MultipartForm = form
+	r.trackForm(form)
+	return nil
+}
+
+// parsedForms holds the multipart forms parsed from a request.
+type parsedForms struct {
+	mu    sync.Mutex
+	forms []*MultipartForm
+}
+
+func (r *Request) trackForm(form *MultipartForm) {
+	if r.forms == nil {
+		r.forms = &parsedForms{}
+	}
+	r.forms.mu.Lock()
+	defer r.forms.mu.Unlock()
+	r.forms.forms = append(r.forms.forms, form)
+}
+
+// RemoveMultipartFiles deletes the temporary files of every form
+// ParseMultipartForm has parsed from r or the copies made of it with
+// WithContext. The server calls it once the handler has returned. Forms read
+// with MultipartReader are left to the handler.
+func (r *Request) RemoveMultipartFiles() error {
+	if r.forms == nil {
+		return nil
+	}
+	r.forms.mu.Lock()
+	forms := r.forms.forms
+	r.forms.forms = nil
+	r.forms.mu.Unlock()
+
+	var errs []error
+	for _, form := range forms {
+		if err := form.RemoveAll(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MultipartReader returns a reader over the parts of a multipart/form-data
+// body, for handlers that want to stream them, e.g. to store an upload without
+// holding it in memory.
+func (r *Request) MultipartReader() (*MultipartReader, error) {
+	mediaType, params, err := mime.ParseMediaType(r.contentType())
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, ErrNotForm
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("%w: no boundary", ErrNotForm)
+	}
+	return NewMultipartReader(r.BodyReader, boundary), nil
+}
+
+func (r *Request) contentType() string {
+	contentType, _ := r.Headers.Get("Content-Type")
+	return contentType
+}
+
+// mediaType returns the Content-Type without parameters, lowercased.
+func (r *Request) mediaType() string {
+	mediaType, _, err := mime.ParseMediaType(r.contentType())
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func hasFormBody(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
@@ -0,0 +1,60 @@
+package request
+
+import "errors"
+
+// Limits bounds how much of a request a Reader will accept before giving up.
+// Zero fields fall back to the defaults below.
+type Limits struct {
+	// MaxRequestLineBytes bounds the request line, excluding its CRLF.
+	MaxRequestLineBytes int
+	// MaxHeaderBytes bounds the header block, including every field line's CRLF.
+	MaxHeaderBytes int
+	// MaxHeaderCount bounds the number of field lines.
+	MaxHeaderCount int
+	// MaxBodyBytes bounds the request body.
+	MaxBodyBytes int64
+}
+
+const (
+	DefaultMaxRequestLineBytes = 8 << 10
+	DefaultMaxHeaderBytes      = 1 << 20
+	DefaultMaxHeaderCount      = 100
+	DefaultMaxBodyBytes        = 10 << 20
+)
+
+var (
+	// ErrRequestLineTooLong maps to 414 URI Too Long.
+	ErrRequestLineTooLong = errors.New("request line too long")
+	// ErrHeaderTooLarge maps to 431 Request Header Fields Too Large.
+	ErrHeaderTooLarge = errors.New("request header fields too large")
+	// ErrBodyTooLarge maps to 413 Content Too Large.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+func (l Limits) maxRequestLineBytes() int {
+	if l.MaxRequestLineBytes > 0 {
+		return l.MaxRequestLineBytes
+	}
+	return DefaultMaxRequestLineBytes
+}
+
+func (l Limits) maxHeaderBytes() int {
+	if l.MaxHeaderBytes > 0 {
+		return l.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+func (l Limits) maxHeaderCount() int {
+	if l.MaxHeaderCount > 0 {
+		return l.MaxHeaderCount
+	}
+	return DefaultMaxHeaderCount
+}
+
+func (l Limits) maxBodyBytes() int64 {
+	if l.MaxBodyBytes > 0 {
+		return l.MaxBodyBytes
+	}
+	return DefaultMaxBodyBytes
+}
@@ -0,0 +1,447 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+)
+
+// MultipartLimits bounds what a MultipartReader accepts. Zero fields fall back
+// to the defaults below.
+type MultipartLimits struct {
+	// MaxParts bounds the number of parts.
+	MaxParts int
+	// MaxFileBytes bounds the size of each file part, i.e. one with a filename.
+	MaxFileBytes int64
+	// MaxMemory bounds how much of each file ReadForm keeps in memory. Bigger
+	// files are spooled to temporary files. It also bounds non-file values, which
+	// are always kept in memory. A negative value disables spooling, so files
+	// are kept in memory whatever their size.
+	MaxMemory int64
+	// TempDir is the directory files are spooled to. Defaults to os.TempDir.
+	TempDir string
+}
+
+const (
+	DefaultMaxParts     = 1000
+	DefaultMaxFileBytes = 10 << 20
+	DefaultMaxMemory    = 1 << 20
+)
+
+const (
+	// maxPartHeaderBytes bounds the header block of a single part
+	maxPartHeaderBytes = 16 << 10
+	// maxBoundaryLineBytes bounds the padding allowed after a boundary
+	maxBoundaryLineBytes = 1 << 10
+	multipartReadSize    = 4 << 10
+)
+
+var (
+	// ErrTooManyParts is returned when a multipart body has more than MaxParts
+	// parts.
+	ErrTooManyParts = errors.New("multipart body has too many parts")
+	// ErrPartTooLarge is returned when a file part is bigger than MaxFileBytes,
+	// or a value part bigger than MaxMemory.
+	ErrPartTooLarge = errors.New("multipart part too large")
+)
+
+func (l MultipartLimits) maxParts() int {
+	if l.MaxParts > 0 {
+		return l.MaxParts
+	}
+	return DefaultMaxParts
+}
+
+func (l MultipartLimits) maxFileBytes() int64 {
+	if l.MaxFileBytes > 0 {
+		return l.MaxFileBytes
+	}
+	return DefaultMaxFileBytes
+}
+
+func (l MultipartLimits) maxMemory() int64 {
+	if l.MaxMemory > 0 {
+		return l.MaxMemory
+	}
+	return DefaultMaxMemory
+}
+
+// MultipartReader reads the parts of a multipart body one at a time, straight
+// from the underlying reader. Only the current part can be read; moving to the
+// next one discards what is left of it.
+type MultipartReader struct {
+	// Limits applies to parts read after it is set.
+	Limits MultipartLimits
+
+	src            io.Reader
+	srcErr         error
+	nlDashBoundary []byte
+	// buf holds bytes read from src but not handed out yet
+	buf     []byte
+	parts   int
+	current *Part
+	done    bool
+}
+
+// NewMultipartReader returns a reader for the multipart body in src whose
+// parts are separated by boundary.
+func NewMultipartReader(src io.Reader, boundary string) *MultipartReader {
+	return &MultipartReader{
+		src:            src,
+		nlDashBoundary: []byte(crlf + "--" + boundary),
+		// A leading CRLF lets the first boundary be found like every other one,
+		// with anything before it skipped as preamble
+		buf: []byte(crlf),
+	}
+}
+
+// Part is a single part of a multipart body. Read returns its content.
+type Part struct {
+	Headers *headers.Headers
+
+	mr     *MultipartReader
+	limit  int64
+	read   int64
+	params map[string]string
+}
+
+// NextPart returns the next part, or io.EOF after the last one.
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.done {
+		return nil, io.EOF
+	}
+
+	// Skip whatever is left of the current part, or the preamble
+	scratch := make([]byte, multipartReadSize)
+	for {
+		_, err := mr.readUntilBoundary(scratch)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	mr.current = nil
+
+	if err := mr.fillTo(len(mr.nlDashBoundary) + 2); err != nil {
+		return nil, err
+	}
+	mr.buf = mr.buf[len(mr.nlDashBoundary):]
+	if bytes.HasPrefix(mr.buf, []byte("--")) {
+		mr.done = true
+		return nil, io.EOF
+	}
+	if err := mr.skipBoundaryLine(); err != nil {
+		return nil, err
+	}
+
+	mr.parts++
+	if mr.parts > mr.Limits.maxParts() {
+		return nil, fmt.Errorf("%w: more than %d", ErrTooManyParts, mr.Limits.maxParts())
+	}
+
+	h, err := mr.readPartHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	part := &Part{Headers: h, mr: mr}
+	if part.FileName() != "" {
+		part.limit = mr.Limits.maxFileBytes()
+	}
+	mr.current = part
+	return part, nil
+}
+
+// skipBoundaryLine consumes the optional whitespace and CRLF that end a
+// boundary line.
+func (mr *MultipartReader) skipBoundaryLine() error {
+	for {
+		idx := bytes.Index(mr.buf, []byte(crlf))
+		if idx >= 0 {
+			if len(bytes.Trim(mr.buf[:idx], " \t")) != 0 {
+				return errors.New("malformed multipart boundary line")
+			}
+			mr.buf = mr.buf[idx+len(crlf):]
+			return nil
+		}
+		if len(mr.buf) > maxBoundaryLineBytes {
+			return errors.New("malformed multipart boundary line")
+		}
+		if err := mr.fill(); err != nil {
+			return err
+		}
+	}
+}
+
+func (mr *MultipartReader) readPartHeaders() (*headers.Headers, error) {
+	h := headers.NewHeaders()
+	headerBytes := 0
+
+	for {
+		n, done, err := h.Parse(mr.buf)
+		if err != nil {
+			return nil, err
+		}
+		mr.buf = mr.buf[n:]
+		headerBytes += n
+
+		if done {
+			return h, nil
+		}
+		if headerBytes > maxPartHeaderBytes {
+			return nil, fmt.Errorf("%w: multipart part headers", ErrHeaderTooLarge)
+		}
+		if n == 0 {
+			if headerBytes+len(mr.buf) > maxPartHeaderBytes {
+				return nil, fmt.Errorf("%w: multipart part headers", ErrHeaderTooLarge)
+			}
+			if err := mr.fill(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// readUntilBoundary reads part content into p, returning io.EOF once the next
+// boundary is at the start of buf.
+func (mr *MultipartReader) readUntilBoundary(p []byte) (int, error) {
+	for {
+		if idx := bytes.Index(mr.buf, mr.nlDashBoundary); idx >= 0 {
+			if idx == 0 {
+				return 0, io.EOF
+			}
+			return mr.consume(p, idx), nil
+		}
+
+		// The tail could be the start of a boundary split across reads, so it
+		// is held back until more has been read
+		if safe := len(mr.buf) - len(mr.nlDashBoundary) + 1; safe > 0 {
+			return mr.consume(p, safe), nil
+		}
+
+		if err := mr.fill(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (mr *MultipartReader) consume(p []byte, limit int) int {
+	n := copy(p, mr.buf[:limit])
+	mr.buf = mr.buf[n:]
+	return n
+}
+
+// fillTo reads until buf holds at least n bytes.
+func (mr *MultipartReader) fillTo(n int) error {
+	for len(mr.buf) < n {
+		if err := mr.fill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill reads more of the body into buf. Running out of body is an error, as a
+// well-formed one ends with the closing boundary.
+func (mr *MultipartReader) fill() error {
+	if mr.srcErr != nil {
+		if errors.Is(mr.srcErr, io.EOF) {
+			return fmt.Errorf("multipart body ended before its closing boundary: %w", io.ErrUnexpectedEOF)
+		}
+		return mr.srcErr
+	}
+
+	data := make([]byte, len(mr.buf), len(mr.buf)+multipartReadSize)
+	copy(data, mr.buf)
+
+	n, err := mr.src.Read(data[len(data):cap(data)])
+	mr.buf = data[:len(data)+n]
+	mr.srcErr = err
+	return nil
+}
+
+func (p *Part) Read(b []byte) (int, error) {
+	if p.mr.current != p {
+		return 0, io.EOF
+	}
+
+	n, err := p.mr.readUntilBoundary(b)
+	p.read += int64(n)
+	if p.limit > 0 && p.read > p.limit {
+		return n, fmt.Errorf("%w: file %q is over %d bytes", ErrPartTooLarge, p.FileName(), p.limit)
+	}
+	return n, err
+}
+
+// FormName returns the name parameter of the part's Content-Disposition, or ""
+// if it is not form-data.
+func (p *Part) FormName() string {
+	if p.disposition() != "form-data" {
+		return ""
+	}
+	return p.params["name"]
+}
+
+// FileName returns the base name of the filename parameter of the part's
+// Content-Disposition, or "" for parts that are not files.
+func (p *Part) FileName() string {
+	p.disposition()
+	filename := p.params["filename"]
+	if filename == "" {
+		return ""
+	}
+	return filepath.Base(filename)
+}
+
+func (p *Part) disposition() string {
+	value, _ := p.Headers.Get("Content-Disposition")
+	disposition, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ""
+	}
+	p.params = params
+	return disposition
+}
+
+// MultipartForm is a fully read multipart/form-data body.
+type MultipartForm struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+// FileHeader describes a file part of a MultipartForm. Its content is held in
+// memory or in a temporary file; Open reads it either way.
+type FileHeader struct {
+	Filename string
+	Headers  *headers.Headers
+	Size     int64
+
+	content []byte
+	tmpfile string
+}
+
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
+
+// Open returns the file's content.
+func (fh *FileHeader) Open() (io.ReadSeekCloser, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return readSeekNopCloser{bytes.NewReader(fh.content)}, nil
+}
+
+// RemoveAll deletes the temporary files of the form.
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, files := range f.File {
+		for _, fh := range files {
+			if fh.tmpfile == "" {
+				continue
+			}
+			if err := os.Remove(fh.tmpfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadForm reads every remaining part into a MultipartForm. Parts without a
+// form name are skipped. On error any temporary files already written are
+// removed.
+func (mr *MultipartReader) ReadForm() (*MultipartForm, error) {
+	form := &MultipartForm{
+		Value: make(map[string][]string),
+		File:  make(map[string][]*FileHeader),
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			_ = form.RemoveAll()
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			maxValue := mr.Limits.maxMemory()
+			data, err := io.ReadAll(io.LimitReader(part, maxValue+1))
+			if err == nil && int64(len(data)) > maxValue {
+				err = fmt.Errorf("%w: value %q is over %d bytes", ErrPartTooLarge, name, maxValue)
+			}
+			if err != nil {
+				_ = form.RemoveAll()
+				return nil, err
+			}
+			form.Value[name] = append(form.Value[name], string(data))
+			continue
+		}
+
+		fh, err := mr.readFile(part)
+		if err != nil {
+			_ = form.RemoveAll()
+			return nil, err
+		}
+		form.File[name] = append(form.File[name], fh)
+	}
+}
+
+// readFile reads a file part into memory, spooling it to a temporary file once
+// it grows past MaxMemory.
+func (mr *MultipartReader) readFile(part *Part) (*FileHeader, error) {
+	fh := &FileHeader{Filename: part.FileName(), Headers: part.Headers}
+
+	var src io.Reader = part
+	if mr.Limits.MaxMemory >= 0 {
+		src = io.LimitReader(part, mr.Limits.maxMemory()+1)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, src)
+	if err != nil {
+		return nil, err
+	}
+	if mr.Limits.MaxMemory < 0 || n <= mr.Limits.maxMemory() {
+		fh.content = buf.Bytes()
+		fh.Size = n
+		return fh, nil
+	}
+
+	file, err := os.CreateTemp(mr.Limits.TempDir, "multipart-")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(file, io.MultiReader(&buf, part))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+
+	fh.tmpfile = file.Name()
+	fh.Size = size
+	return fh, nil
+}
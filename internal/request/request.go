@@ -3,9 +3,13 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/url"
 	"strconv"
 	"strings"
 	"unicode"
@@ -19,77 +23,342 @@ const (
 	parsingRequestLine requestState = iota
 	parsingHeaders
 	parsingBody
+	parsingChunkSize
+	parsingChunkData
+	parsingTrailers
 	doneParsing
 )
 
 type Request struct {
 	RequestLine RequestLine
-	Headers     headers.Headers
-	Body        []byte
-	state       requestState
+	// Target is RequestLine.RequestTarget parsed into its path and query
+	Target  Target
+	Headers *headers.Headers
+	// Body is only filled once the body has been buffered, either by
+	// RequestFromReader or by calling BufferBody
+	Body []byte
+	// BodyReader streams the body straight off the connection. It returns EOF at
+	// the end of the Content-Length or chunked body.
+	BodyReader io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body
+	Trailers *headers.Headers
+	// Form holds the query and form body values once ParseForm or
+	// ParseMultipartForm has been called
+	Form url.Values
+	// PostForm holds only the form body values, filled alongside Form
+	PostForm url.Values
+	// MultipartForm holds a parsed multipart/form-data body, including its
+	// files, once ParseMultipartForm has been called
+	MultipartForm *MultipartForm
+	// RemoteAddr is the address of the client, filled in by the server
+	RemoteAddr string
+	// TLS describes the TLS connection the request arrived on, with the
+	// negotiated version, cipher suite and peer certificates. It is nil for
+	// plaintext connections.
+	TLS *tls.ConnectionState
+	// pathValues holds the wildcards matched by the route the request took
+	pathValues map[string]string
+	ctx        context.Context
+	state      requestState
+	// formErr and multipartErr remember why a form body could not be parsed,
+	// as it cannot be read a second time
+	formErr      error
+	multipartErr error
+	// forms is shared with copies made by WithContext, so the server can
+	// remove files spooled by a form parsed on any of them
+	forms *parsedForms
+
+	limits         Limits
+	headerBytes    int
+	headerCount    int
+	contentLength  int64
+	chunkRemaining int64
+	bodyBytesRead  int64
+	// decoded holds body bytes parsed off the connection that BodyReader has
+	// not handed out yet
+	decoded []byte
 }
 
 type RequestLine struct {
 	HTTPVersion   string
 	RequestTarget string
 	Method        string
+	// ProtoMajor and ProtoMinor are HTTPVersion as numbers, e.g. 1 and 0 for
+	// HTTP/1.0. Later 1.x versions are read as 1.1, the highest the server
+	// speaks
+	ProtoMajor int
+	ProtoMinor int
 }
 
+// ErrVersionNotSupported is returned for a well-formed request line whose HTTP
+// major version is not 1.
+var ErrVersionNotSupported = errors.New("HTTP version not supported")
+
 const (
 	crlf       = "\r\n"
 	bufferSize = 8
 )
 
+// NewRequest builds a request that did not come off a connection, such as one
+// handed over from net/http or made up in a test. body may be nil.
+func NewRequest(method, target string, body io.Reader) *Request {
+	// A target that does not parse leaves Target empty, as there is no client
+	// to answer with a 400
+	parsedTarget, _ := ParseTarget(method, target)
+
+	req := &Request{
+		RequestLine: RequestLine{
+			HTTPVersion:   "1.1",
+			RequestTarget: target,
+			Method:        method,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+		},
+		Target:   parsedTarget,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		Body:     make([]byte, 0),
+		state:    doneParsing,
+		forms:    &parsedForms{},
+	}
+
+	switch b := body.(type) {
+	case nil:
+		req.BodyReader = io.NopCloser(bytes.NewReader(nil))
+	case io.ReadCloser:
+		req.BodyReader = b
+	default:
+		req.BodyReader = io.NopCloser(b)
+	}
+	return req
+}
+
+// Reader reads successive requests from a single connection. Bytes read past
+// the end of one request are kept and used for the next, so pipelined requests
+// sent back-to-back are not lost.
+type Reader struct {
+	// Limits applies to every request read after it is set.
+	Limits Limits
+
+	src         io.Reader
+	buff        []byte
+	readToIndex int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		src:  reader,
+		buff: make([]byte, bufferSize),
+	}
+}
+
+// RequestFromReader parses a single request from reader. Anything read past
+// the end of the request is discarded; use a Reader to parse several requests
+// from the same stream.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buff := make([]byte, bufferSize)
-	readToIndex := 0
+	return NewReader(reader).ReadRequest()
+}
+
+// ReadRequest reads the next request with its body fully buffered in Body.
+func (rd *Reader) ReadRequest() (*Request, error) {
+	req, err := rd.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.BufferBody(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
+// ReadHeader parses the request line and headers of the next request and
+// returns as soon as they are done. The body is left on the connection and
+// exposed as req.BodyReader, which must be closed before the next request is
+// read.
+func (rd *Reader) ReadHeader() (*Request, error) {
 	req := &Request{
-		Headers: headers.NewHeaders(),
-		state:   parsingRequestLine,
-		Body:    make([]byte, 0),
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		state:    parsingRequestLine,
+		Body:     make([]byte, 0),
+		limits:   rd.Limits,
+		forms:    &parsedForms{},
 	}
 
-	for req.state != doneParsing {
-		if readToIndex >= len(buff) {
-			newBuff := make([]byte, len(buff)*2)
-			copy(newBuff, buff)
-			buff = newBuff
-		}
+	err := rd.parseUntil(req, func() bool { return req.state >= parsingBody })
+	if err != nil {
+		return nil, err
+	}
 
-		numBytesRead, err := reader.Read(buff[readToIndex:])
-		// Sample solution sees problem here - std io.Reader can read into buffer AND return EOF error.
-		// We want to ensure we flush our buffer before handling EOF error
+	req.BodyReader = &body{reader: rd, req: req}
+	return req, nil
+}
 
-		if numBytesRead > 0 {
-			readToIndex += numBytesRead
+// WaitForRequest blocks until the first byte of the next request is available,
+// which lets callers time the idle period between requests separately from
+// reading the request itself. It returns io.EOF if the peer closes first.
+func (rd *Reader) WaitForRequest() error {
+	if rd.readToIndex > 0 {
+		return nil
+	}
 
-			numBytesParsed, parseErr := req.parse(buff[:readToIndex])
-			if parseErr != nil {
-				return nil, parseErr
-			}
+	for {
+		numBytesRead, err := rd.src.Read(rd.buff)
+		rd.readToIndex += numBytesRead
 
-			copy(buff, buff[numBytesParsed:])
-			readToIndex -= numBytesParsed
+		if numBytesRead > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
+	}
+}
 
+// parseUntil reads and parses data until done reports true. Request line and
+// headers are parsed on their own, the body is only parsed once asked for.
+func (rd *Reader) parseUntil(req *Request, done func() bool) error {
+	var readErr error
+
+	until := parsingBody
+	if req.state >= parsingBody {
+		until = doneParsing
+	}
+
+	for {
+		// Leftovers from the previous request may already hold this one, so parse
+		// before reading to avoid blocking on a client waiting for its response.
+		// Parsing an empty buffer still lets body-less requests finish
+		numBytesParsed, err := req.parse(rd.buff[:rd.readToIndex], until)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if req.state != doneParsing {
-					return nil, fmt.Errorf("incomplete request")
+			return err
+		}
+
+		copy(rd.buff, rd.buff[numBytesParsed:rd.readToIndex])
+		rd.readToIndex -= numBytesParsed
+
+		if done() {
+			return nil
+		}
+
+		// std io.Reader can read into buffer AND return EOF error. The bytes were
+		// parsed above, so only now is the error handled
+		if readErr != nil {
+			if errors.Is(readErr, io.EOF) {
+				if req.state == parsingRequestLine && rd.readToIndex == 0 {
+					// Peer closed the connection before sending anything, which is
+					// how an idle keep-alive connection normally ends
+					return io.EOF
 				}
-				break
+				return fmt.Errorf("incomplete request: %w", io.ErrUnexpectedEOF)
 			}
-			return nil, err
+			return readErr
 		}
+
+		if rd.readToIndex >= len(rd.buff) {
+			newBuff := make([]byte, len(rd.buff)*2)
+			copy(newBuff, rd.buff)
+			rd.buff = newBuff
+		}
+
+		var numBytesRead int
+		numBytesRead, readErr = rd.src.Read(rd.buff[rd.readToIndex:])
+		rd.readToIndex += numBytesRead
 	}
-	return req, nil
 }
 
-func (r *Request) parse(data []byte) (int, error) {
+// KeepAlive reports whether the client is willing to send further requests on
+// the same connection. HTTP/1.1 connections are persistent unless the client
+// sends Connection: close, HTTP/1.0 ones only if it sends Connection:
+// keep-alive.
+func (r *Request) KeepAlive() bool {
+	if r.Headers.HasToken("Connection", "close") {
+		return false
+	}
+	if r.ProtoAtLeast(1, 1) {
+		return true
+	}
+	return r.Headers.HasToken("Connection", "keep-alive")
+}
+
+// ProtoAtLeast reports whether the request's HTTP version is at least
+// major.minor.
+func (r *Request) ProtoAtLeast(major, minor int) bool {
+	return r.RequestLine.ProtoMajor > major ||
+		r.RequestLine.ProtoMajor == major && r.RequestLine.ProtoMinor >= minor
+}
+
+// Context returns the request's context. For requests served by the server it
+// is cancelled when the client goes away, the server closes or the handler
+// timeout passes. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx. The
+// copy shares the body, so only one of the two should be read from.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	r2.pathValues = maps.Clone(r.pathValues)
+	return r2
+}
+
+// WithValue returns a copy of r whose context carries value under key, for
+// middleware to pass data on to the handlers it wraps.
+func (r *Request) WithValue(key, value any) *Request {
+	return r.WithContext(context.WithValue(r.Context(), key, value))
+}
+
+// Value returns the value stored under key in the request's context, or nil.
+func (r *Request) Value(key any) any {
+	return r.Context().Value(key)
+}
+
+// BodyComplete reports whether the whole body has been read off the
+// connection, so that anything read from it after belongs to the next request.
+func (r *Request) BodyComplete() bool {
+	// Copies made by WithContext share the original's body, which is where the
+	// parsing state is kept up to date
+	if b, ok := r.BodyReader.(*body); ok {
+		r = b.req
+	}
+	return r.state == doneParsing && len(r.decoded) == 0
+}
+
+// Query returns the decoded query parameters of the request target.
+func (r *Request) Query() url.Values {
+	return r.Target.Query()
+}
+
+// PathValue returns the value the named wildcard matched in the pattern that
+// routed the request, or "" if the pattern has no such wildcard.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue sets the value PathValue returns for name. Routers call it when
+// they match a request.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
+
+func (r *Request) parse(data []byte, until requestState) (int, error) {
 	totalBytesParsed := 0
 
-	for r.state != doneParsing {
+	for r.state < until {
 		numBytesParsed, err := r.parseSingleChunk(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
@@ -125,36 +394,38 @@ func (r *Request) parseSingleChunk(data []byte) (int, error) {
 			return 0, err
 		}
 
+		if err := r.checkFieldLimits(numBytesParsed, done, len(data)); err != nil {
+			return 0, err
+		}
+
 		if done {
-			r.state = parsingBody
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
 		}
 
 		return numBytesParsed, nil
 
 	case parsingBody:
-		contentLenStr, ok := r.Headers.Get("Content-Length")
-		if !ok {
-			// We are assuming that since this header does not exist, there is no body
+		// Only take what the header promised, the rest is the next request
+		numBytesParsed := int(min(int64(len(data)), r.contentLength-r.bodyBytesRead))
+		r.decoded = append(r.decoded, data[:numBytesParsed]...)
+		r.bodyBytesRead += int64(numBytesParsed)
+
+		if r.bodyBytesRead == r.contentLength {
 			r.state = doneParsing
-			return len(data), nil
 		}
 
-		contentLength, err := strconv.Atoi(contentLenStr)
-		if err != nil {
-			return 0, err
-		}
+		return numBytesParsed, nil
 
-		r.Body = append(r.Body, data...)
-		bodyLength := len(r.Body)
-		if bodyLength > contentLength {
-			return 0, fmt.Errorf("body is of length %d but header specified %d", bodyLength, contentLength)
-		}
+	case parsingChunkSize:
+		return r.parseChunkSize(data)
 
-		if bodyLength == contentLength {
-			r.state = doneParsing
-		}
+	case parsingChunkData:
+		return r.parseChunkData(data)
 
-		return len(data), nil
+	case parsingTrailers:
+		return r.parseTrailers(data)
 
 	case doneParsing:
 		return 0, errors.New("trying to read more data when request has finished parsing")
@@ -164,12 +435,94 @@ func (r *Request) parseSingleChunk(data []byte) (int, error) {
 	}
 }
 
+// startBody works out how the body is framed once the headers are done, so
+// that bad or oversized framing is reported before any handler runs.
+func (r *Request) startBody() error {
+	if _, ok := r.Headers.Get("Transfer-Encoding"); ok {
+		if err := r.checkTransferEncoding(); err != nil {
+			return err
+		}
+		r.state = parsingChunkSize
+		return nil
+	}
+
+	contentLenStr, ok := r.Headers.Get("Content-Length")
+	if !ok {
+		// We are assuming that since this header does not exist, there is no body.
+		// Any remaining bytes belong to the next pipelined request
+		r.state = doneParsing
+		return nil
+	}
+
+	contentLength, err := parseContentLength(contentLenStr)
+	if err != nil {
+		return err
+	}
+	if contentLength > r.limits.maxBodyBytes() {
+		return fmt.Errorf("%w: content length %d", ErrBodyTooLarge, contentLength)
+	}
+
+	r.contentLength = contentLength
+	r.state = parsingBody
+	if contentLength == 0 {
+		r.state = doneParsing
+	}
+	return nil
+}
+
+// parseContentLength parses a Content-Length value, which must be digits only:
+// a sign or space inside it could be read differently by a proxy in front of
+// the server, letting a request be smuggled past it. A list of identical
+// values, from repeated fields, counts as one.
+func parseContentLength(value string) (int64, error) {
+	var length string
+	for v := range strings.SplitSeq(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || !isDigits(v) {
+			return 0, fmt.Errorf("invalid content length %q", value)
+		}
+		if length != "" && v != length {
+			return 0, fmt.Errorf("conflicting content lengths %q", value)
+		}
+		length = v
+	}
+
+	contentLength, err := strconv.ParseInt(length, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid content length %q", value)
+	}
+	return contentLength, nil
+}
+
+// checkFieldLimits accounts for a header or trailer field line that has just
+// been parsed and reports whether the limits on them have been exceeded.
+func (r *Request) checkFieldLimits(numBytesParsed int, done bool, bufferedBytes int) error {
+	// An incomplete line counts towards the limit too, otherwise a client could
+	// grow the read buffer forever by never sending CRLF
+	r.headerBytes += numBytesParsed
+	if r.headerBytes > r.limits.maxHeaderBytes() ||
+		(numBytesParsed == 0 && r.headerBytes+bufferedBytes > r.limits.maxHeaderBytes()) {
+		return ErrHeaderTooLarge
+	}
+
+	if !done && numBytesParsed > 0 {
+		r.headerCount++
+		if r.headerCount > r.limits.maxHeaderCount() {
+			return ErrHeaderTooLarge
+		}
+	}
+	return nil
+}
+
 func (r *Request) parseRequestLine(data []byte) (int, error) {
 	if r.state != parsingRequestLine {
 		return 0, errors.New("trying to read data in a done state")
 	}
 
 	idx := bytes.Index(data, []byte(crlf))
+	if idx > r.limits.maxRequestLineBytes() || (idx == -1 && len(data) > r.limits.maxRequestLineBytes()) {
+		return 0, ErrRequestLineTooLong
+	}
 	if idx == -1 {
 		return 0, nil
 	}
@@ -179,6 +532,10 @@ func (r *Request) parseRequestLine(data []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	target, err := ParseTarget(requestLine.Method, requestLine.RequestTarget)
+	if err != nil {
+		return 0, err
+	}
 
 	numBytesParsed := idx + len(crlf)
 	if numBytesParsed == 0 {
@@ -186,6 +543,7 @@ func (r *Request) parseRequestLine(data []byte) (int, error) {
 	}
 
 	r.RequestLine = requestLine
+	r.Target = target
 	return numBytesParsed, nil
 }
 
@@ -202,22 +560,53 @@ func requestLineFromString(line string) (RequestLine, error) {
 
 	addr := parts[1]
 
-	protocolName := strings.Split(parts[2], "/")
-	if protocolName[0] != "HTTP" {
+	version, ok := strings.CutPrefix(parts[2], "HTTP/")
+	if !ok {
 		return RequestLine{}, errors.New("protocol is not HTTP")
 	}
-	if protocolName[1] != "1.1" {
-		return RequestLine{}, errors.New("HTTP version does not match 1.1")
+	major, minor, err := parseHTTPVersion(version)
+	if err != nil {
+		return RequestLine{}, err
 	}
 
 	return RequestLine{
 			Method:        method,
 			RequestTarget: addr,
-			HTTPVersion:   "1.1",
+			HTTPVersion:   version,
+			ProtoMajor:    major,
+			ProtoMinor:    minor,
 		},
 		nil
 }
 
+// parseHTTPVersion parses the digit.digit version after "HTTP/". Major
+// versions other than 1 are well-formed but not supported. Minor versions are
+// compatible within a major version, so those above 1 are treated as 1.1.
+func parseHTTPVersion(version string) (int, int, error) {
+	if len(version) != 3 || version[1] != '.' || !isDigit(version[0]) || !isDigit(version[2]) {
+		return 0, 0, fmt.Errorf("malformed HTTP version %q", version)
+	}
+
+	major, minor := int(version[0]-'0'), int(version[2]-'0')
+	if major != 1 {
+		return 0, 0, fmt.Errorf("%w: HTTP/%s", ErrVersionNotSupported, version)
+	}
+	return major, min(minor, 1), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isDigits(s string) bool {
+	for i := range len(s) {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func isUpper(s string) bool {
 	for _, r := range s {
 		if !unicode.IsUpper(r) || !unicode.IsLetter(r) {
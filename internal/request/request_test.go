@@ -1,7 +1,11 @@
 package request
 
 import (
+	"context"
 	"io"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,6 +31,12 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// header returns the combined value of the request header key, or "" if unset.
+func header(r *Request, key string) string {
+	val, _ := r.Headers.Get(key)
+	return val
+}
+
 func TestRequestLineParse(t *testing.T) {
 	t.Run("Good GET Request line", func(t *testing.T) {
 		reader := &chunkReader{
@@ -125,13 +135,97 @@ func TestRequestLineParse(t *testing.T) {
 		require.Error(t, err)
 	})
 
-	t.Run("Invalid HTTP version number", func(t *testing.T) {
+	t.Run("Later HTTP/1.x version", func(t *testing.T) {
 		reader := &chunkReader{
 			data:            "GET /coffee HTTP/1.3\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
 			numBytesPerRead: 1,
 		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "1.3", r.RequestLine.HTTPVersion)
+		assert.Equal(t, 1, r.RequestLine.ProtoMajor)
+		assert.Equal(t, 1, r.RequestLine.ProtoMinor)
+
+		r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.2\r\n\r\n"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, r.RequestLine.ProtoMinor)
+		assert.True(t, r.KeepAlive())
+	})
+
+	t.Run("HTTP/1.0 request line", func(t *testing.T) {
+		r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+		require.NoError(t, err)
+		assert.Equal(t, "1.0", r.RequestLine.HTTPVersion)
+		assert.Equal(t, 1, r.RequestLine.ProtoMajor)
+		assert.Equal(t, 0, r.RequestLine.ProtoMinor)
+		assert.False(t, r.ProtoAtLeast(1, 1))
+
+		r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, r.RequestLine.ProtoMinor)
+		assert.True(t, r.ProtoAtLeast(1, 0))
+	})
+
+	t.Run("Malformed HTTP versions", func(t *testing.T) {
+		for _, version := range []string{"HTTP", "HTTP/", "HTTP/1", "HTTP/1.", "HTTP/11", "HTTP/x.y", "HTTP/1.1.1"} {
+			assert.NotPanics(t, func() {
+				_, err := RequestFromReader(strings.NewReader("GET / " + version + "\r\n\r\n"))
+				require.Error(t, err, version)
+				assert.NotErrorIs(t, err, ErrVersionNotSupported, version)
+			})
+		}
+	})
+
+	t.Run("Unsupported HTTP versions", func(t *testing.T) {
+		for _, version := range []string{"HTTP/0.9", "HTTP/2.0", "HTTP/3.0"} {
+			_, err := RequestFromReader(strings.NewReader("GET / " + version + "\r\n\r\n"))
+			assert.ErrorIs(t, err, ErrVersionNotSupported, version)
+		}
+	})
+}
+
+func TestConnectionPersistence(t *testing.T) {
+	t.Run("Keep alive by default", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.True(t, r.KeepAlive())
+	})
+
+	t.Run("Client asks to close", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: close\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.False(t, r.KeepAlive())
+	})
+
+	t.Run("HTTP/1.0 closes unless asked", func(t *testing.T) {
+		r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+		require.NoError(t, err)
+		assert.False(t, r.KeepAlive())
+
+		r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n"))
+		require.NoError(t, err)
+		assert.True(t, r.KeepAlive())
+	})
+
+	t.Run("Closed before request line", func(t *testing.T) {
+		reader := &chunkReader{data: "", numBytesPerRead: 3}
+		_, err := RequestFromReader(reader)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Closed mid request line", func(t *testing.T) {
+		reader := &chunkReader{data: "GET / HT", numBytesPerRead: 3}
 		_, err := RequestFromReader(reader)
 		require.Error(t, err)
+		assert.NotErrorIs(t, err, io.EOF)
 	})
 }
 
@@ -144,9 +238,9 @@ func TestHeadersParse(t *testing.T) {
 		r, err := RequestFromReader(reader)
 		require.NoError(t, err)
 		require.NotNil(t, r)
-		assert.Equal(t, "localhost:42069", r.Headers["host"])
-		assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-		assert.Equal(t, "*/*", r.Headers["accept"])
+		assert.Equal(t, "localhost:42069", header(r, "host"))
+		assert.Equal(t, "curl/7.81.0", header(r, "user-agent"))
+		assert.Equal(t, "*/*", header(r, "accept"))
 	})
 
 	t.Run("Empty Headers", func(t *testing.T) {
@@ -158,7 +252,7 @@ func TestHeadersParse(t *testing.T) {
 		require.NoError(t, err)
 		require.NotNil(t, r)
 		require.NotNil(t, r.Headers)
-		assert.Len(t, r.Headers, 0)
+		assert.Equal(t, 0, r.Headers.Len())
 	})
 
 	t.Run("Duplicate Headers", func(t *testing.T) {
@@ -169,8 +263,8 @@ func TestHeadersParse(t *testing.T) {
 		r, err := RequestFromReader(reader)
 		require.NoError(t, err)
 		require.NotNil(t, r)
-		assert.Equal(t, "firefox, curl/7.81.0", r.Headers["user-agent"])
-		assert.Equal(t, "*/*", r.Headers["accept"])
+		assert.Equal(t, "firefox, curl/7.81.0", header(r, "user-agent"))
+		assert.Equal(t, "*/*", header(r, "accept"))
 	})
 
 	t.Run("Malformed Header", func(t *testing.T) {
@@ -248,6 +342,41 @@ func TestBodyParse(t *testing.T) {
 		require.Error(t, err)
 	})
 
+	t.Run("Content-Length values", func(t *testing.T) {
+		for _, value := range []string{"+2", "-2", "0x2", " ", "2 2", "2, 3", "2,", "99999999999999999999"} {
+			_, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: " + value + "\r\n\r\nhi"))
+			assert.Error(t, err, value)
+		}
+
+		// Repeated identical values, in one field or several, count as one
+		r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 2, 2\r\n\r\nhi"))
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(r.Body))
+
+		r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nhi"))
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(r.Body))
+	})
+
+	t.Run("Headers and body read separately", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Content-Length: 13\r\n" +
+				"\r\n" +
+				"hello world!\n",
+			numBytesPerRead: 3,
+		})
+		require.NoError(t, reader.WaitForRequest())
+
+		r, err := reader.ReadHeader()
+		require.NoError(t, err)
+		assert.Equal(t, "POST", r.RequestLine.Method)
+		assert.Equal(t, "", string(r.Body))
+
+		require.NoError(t, r.BufferBody())
+		assert.Equal(t, "hello world!\n", string(r.Body))
+	})
+
 	t.Run("No conent-length but body exists", func(t *testing.T) {
 		reader := &chunkReader{
 			data: "POST /submit HTTP/1.1\r\n" +
@@ -262,3 +391,700 @@ func TestBodyParse(t *testing.T) {
 		assert.Equal(t, "", string(r.Body))
 	})
 }
+
+func TestPipelinedRequests(t *testing.T) {
+	t.Run("Requests without bodies", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "GET /first HTTP/1.1\r\nHost: localhost:42069\r\n\r\nGET /second HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 50,
+		})
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+
+		r, err = reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+		_, err = reader.ReadRequest()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Body does not swallow next request", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Content-Length: 5\r\n" +
+				"\r\n" +
+				"helloGET /next HTTP/1.1\r\n\r\n",
+			numBytesPerRead: 1024,
+		})
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(r.Body))
+
+		r, err = reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "GET", r.RequestLine.Method)
+		assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	})
+}
+
+func TestLimits(t *testing.T) {
+	t.Run("Request line too long", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\n\r\n",
+			numBytesPerRead: 8,
+		})
+		reader.Limits = Limits{MaxRequestLineBytes: 32}
+		_, err := reader.ReadRequest()
+		assert.ErrorIs(t, err, ErrRequestLineTooLong)
+	})
+
+	t.Run("Request line without CRLF", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "GET /" + strings.Repeat("a", 64),
+			numBytesPerRead: 8,
+		})
+		reader.Limits = Limits{MaxRequestLineBytes: 32}
+		_, err := reader.ReadRequest()
+		assert.ErrorIs(t, err, ErrRequestLineTooLong)
+	})
+
+	t.Run("Header block too large", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 64) + "\r\n\r\n",
+			numBytesPerRead: 8,
+		})
+		reader.Limits = Limits{MaxHeaderBytes: 32}
+		_, err := reader.ReadRequest()
+		assert.ErrorIs(t, err, ErrHeaderTooLarge)
+	})
+
+	t.Run("Too many headers", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+			numBytesPerRead: 8,
+		})
+		reader.Limits = Limits{MaxHeaderCount: 2}
+		_, err := reader.ReadRequest()
+		assert.ErrorIs(t, err, ErrHeaderTooLarge)
+	})
+
+	t.Run("Headers within limits", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\n\r\n",
+			numBytesPerRead: 8,
+		})
+		reader.Limits = Limits{MaxHeaderCount: 2, MaxHeaderBytes: 14}
+		_, err := reader.ReadRequest()
+		require.NoError(t, err)
+	})
+
+	t.Run("Body too large", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "POST / HTTP/1.1\r\nContent-Length: 100\r\n\r\n",
+			numBytesPerRead: 8,
+		})
+		reader.Limits = Limits{MaxBodyBytes: 10}
+		_, err := reader.ReadRequest()
+		assert.ErrorIs(t, err, ErrBodyTooLarge)
+	})
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	t.Run("Valid chunked body", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"6\r\nhello \r\n" +
+				"7\r\nworld!\n\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		assert.Equal(t, "hello world!\n", string(r.Body))
+	})
+
+	t.Run("One byte per read", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"1a\r\nabcdefghijklmnopqrstuvwxyz\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 1,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "abcdefghijklmnopqrstuvwxyz", string(r.Body))
+	})
+
+	t.Run("Chunk extensions are ignored", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"5;name=value;flag\r\nhello\r\n" +
+				"0;last\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(r.Body))
+	})
+
+	t.Run("Trailers", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"Trailer: X-Checksum\r\n" +
+				"\r\n" +
+				"5\r\nhello\r\n" +
+				"0\r\n" +
+				"X-Checksum: abc123\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(r.Body))
+		checksum, ok := r.Trailers.Get("X-Checksum")
+		assert.True(t, ok)
+		assert.Equal(t, "abc123", checksum)
+	})
+
+	t.Run("Trailer with empty field name", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"0\r\n" +
+				": x\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+
+	t.Run("Empty chunked body", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "", string(r.Body))
+	})
+
+	t.Run("Missing terminating chunk", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"5\r\nhello\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+
+	t.Run("Chunk shorter than reported size", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"a\r\nhello",
+			numBytesPerRead: 3,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+
+	t.Run("Chunk longer than reported size", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"3\r\nhello\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+
+	t.Run("Invalid chunk size", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"-5\r\nhello\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+
+	t.Run("Content-Length alongside chunked", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"Content-Length: 5\r\n" +
+				"\r\n" +
+				"5\r\nhello\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+
+	t.Run("Unsupported transfer coding", func(t *testing.T) {
+		for _, te := range []string{"gzip", "gzip, chunked", "chunked, chunked", "identity"} {
+			reader := &chunkReader{
+				data: "POST /submit HTTP/1.1\r\n" +
+					"Transfer-Encoding: " + te + "\r\n" +
+					"\r\n" +
+					"0\r\n" +
+					"\r\n",
+				numBytesPerRead: 3,
+			}
+			_, err := RequestFromReader(reader)
+			assert.ErrorIs(t, err, ErrUnsupportedTransferEncoding, te)
+		}
+
+		// Several fields add up to the same list of codings
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: gzip\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err := RequestFromReader(reader)
+		assert.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+	})
+
+	t.Run("Chunked body too large", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"5\r\nhello\r\n" +
+				"5\r\nworld\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		})
+		reader.Limits = Limits{MaxBodyBytes: 8}
+		_, err := reader.ReadRequest()
+		assert.ErrorIs(t, err, ErrBodyTooLarge)
+	})
+
+	t.Run("Next pipelined request is kept", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"5\r\nhello\r\n" +
+				"0\r\n" +
+				"\r\n" +
+				"GET /next HTTP/1.1\r\n\r\n",
+			numBytesPerRead: 1024,
+		})
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(r.Body))
+
+		r, err = reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	})
+}
+
+func TestStreamingBody(t *testing.T) {
+	t.Run("Content-Length body", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Content-Length: 13\r\n" +
+				"\r\n" +
+				"hello world!\n",
+			numBytesPerRead: 3,
+		})
+		r, err := reader.ReadHeader()
+		require.NoError(t, err)
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(r.BodyReader, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+
+		rest, err := io.ReadAll(r.BodyReader)
+		require.NoError(t, err)
+		assert.Equal(t, " world!\n", string(rest))
+		require.NoError(t, r.BodyReader.Close())
+	})
+
+	t.Run("Chunked body", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"6\r\nhello \r\n" +
+				"7\r\nworld!\n\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 4,
+		})
+		r, err := reader.ReadHeader()
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(r.BodyReader)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world!\n", string(data))
+	})
+
+	t.Run("Truncated body", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Content-Length: 20\r\n" +
+				"\r\n" +
+				"partial content",
+			numBytesPerRead: 3,
+		})
+		r, err := reader.ReadHeader()
+		require.NoError(t, err)
+
+		_, err = io.ReadAll(r.BodyReader)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("Oversized Content-Length rejected with headers", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "POST /submit HTTP/1.1\r\nContent-Length: 100\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		reader.Limits = Limits{MaxBodyBytes: 10}
+		_, err := reader.ReadHeader()
+		assert.ErrorIs(t, err, ErrBodyTooLarge)
+	})
+
+	t.Run("Close drains unread body", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Content-Length: 5\r\n" +
+				"\r\n" +
+				"hello" +
+				"GET /next HTTP/1.1\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		r, err := reader.ReadHeader()
+		require.NoError(t, err)
+		require.NoError(t, r.BodyReader.Close())
+
+		_, err = r.BodyReader.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, ErrBodyReadAfterClose)
+
+		r, err = reader.ReadHeader()
+		require.NoError(t, err)
+		assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	})
+}
+
+func TestContext(t *testing.T) {
+	type ctxKey string
+
+	t.Run("Defaults to background", func(t *testing.T) {
+		req := NewRequest("GET", "/", nil)
+		assert.Equal(t, context.Background(), req.Context())
+		assert.Nil(t, req.Value(ctxKey("missing")))
+	})
+
+	t.Run("WithContext returns a copy", func(t *testing.T) {
+		req := NewRequest("GET", "/", nil)
+		req.SetPathValue("id", "1")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req2 := req.WithContext(ctx)
+		req2.SetPathValue("id", "2")
+
+		assert.Equal(t, ctx, req2.Context())
+		assert.Equal(t, context.Background(), req.Context())
+		assert.Equal(t, "1", req.PathValue("id"))
+		assert.Equal(t, "2", req2.PathValue("id"))
+		assert.Panics(t, func() { req.WithContext(nil) })
+	})
+
+	t.Run("WithValue", func(t *testing.T) {
+		req := NewRequest("GET", "/", nil).WithValue(ctxKey("user"), "alice").WithValue(ctxKey("role"), "admin")
+
+		assert.Equal(t, "alice", req.Value(ctxKey("user")))
+		assert.Equal(t, "admin", req.Value(ctxKey("role")))
+	})
+
+	t.Run("Copy tracks body completion", func(t *testing.T) {
+		reader := NewReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"))
+		req, err := reader.ReadHeader()
+		require.NoError(t, err)
+		req2 := req.WithContext(context.Background())
+		assert.False(t, req2.BodyComplete())
+
+		_, err = io.ReadAll(req2.BodyReader)
+		require.NoError(t, err)
+		assert.True(t, req2.BodyComplete())
+		assert.True(t, req.BodyComplete())
+	})
+}
+
+func TestTargetParse(t *testing.T) {
+	t.Run("Target forms", func(t *testing.T) {
+		tests := []struct {
+			method, target string
+			want           Target
+		}{
+			{"GET", "/", Target{Form: OriginForm, Path: "/", RawPath: "/"}},
+			{"GET", "/a%20b/c%2Fd?x=1", Target{Form: OriginForm, Path: "/a b/c/d", RawPath: "/a%20b/c%2Fd", RawQuery: "x=1"}},
+			{"GET", "http://Example.com:8080/p?q", Target{Form: AbsoluteForm, Scheme: "http", Host: "Example.com:8080", Path: "/p", RawPath: "/p", RawQuery: "q"}},
+			{"GET", "https://example.com", Target{Form: AbsoluteForm, Scheme: "https", Host: "example.com", Path: "/", RawPath: "/"}},
+			{"GET", "http://example.com?x=1", Target{Form: AbsoluteForm, Scheme: "http", Host: "example.com", Path: "/", RawPath: "/", RawQuery: "x=1"}},
+			{"CONNECT", "example.com:443", Target{Form: AuthorityForm, Host: "example.com:443"}},
+			{"CONNECT", "[::1]:443", Target{Form: AuthorityForm, Host: "[::1]:443"}},
+			{"OPTIONS", "*", Target{Form: AsteriskForm, Path: "*", RawPath: "*"}},
+		}
+
+		for _, tc := range tests {
+			got, err := ParseTarget(tc.method, tc.target)
+			require.NoError(t, err, tc.target)
+			got.query = nil
+			assert.Equal(t, tc.want, got, tc.target)
+		}
+	})
+
+	t.Run("Multi-valued query", func(t *testing.T) {
+		r, err := RequestFromReader(strings.NewReader("GET /search?tag=a&tag=b%20c&q=x+y&empty=&flag&semi=a;b HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+
+		query := r.Query()
+		assert.Equal(t, []string{"a", "b c"}, query["tag"])
+		assert.Equal(t, "x y", query.Get("q"))
+		assert.True(t, query.Has("empty"))
+		assert.True(t, query.Has("flag"))
+		assert.Equal(t, "a;b", query.Get("semi"))
+		assert.Equal(t, "/search", r.Target.Path)
+	})
+
+	t.Run("No query", func(t *testing.T) {
+		r := NewRequest("GET", "/", nil)
+		assert.Empty(t, r.Query())
+		assert.Equal(t, "", r.Query().Get("missing"))
+	})
+
+	t.Run("Invalid targets", func(t *testing.T) {
+		tests := []struct{ method, target string }{
+			{"GET", "/%zz"},
+			{"GET", "/a%2"},
+			{"GET", "/?q=%zz"},
+			{"GET", "/page#frag"},
+			{"GET", "/caf\xc3\xa9"},
+			{"GET", "*"},
+			{"GET", "users"},
+			{"GET", "ftp:/x"},
+			{"GET", "1http://x/"},
+			{"GET", "http:///path"},
+			{"GET", "http://user@host/"},
+			{"CONNECT", "/path"},
+			{"CONNECT", "example.com"},
+			{"CONNECT", "example.com:https"},
+		}
+
+		for _, tc := range tests {
+			_, err := ParseTarget(tc.method, tc.target)
+			assert.ErrorIs(t, err, ErrInvalidTarget, "%s %s", tc.method, tc.target)
+		}
+
+		_, err := RequestFromReader(strings.NewReader("GET /%zz HTTP/1.1\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrInvalidTarget)
+	})
+}
+
+func TestForms(t *testing.T) {
+	t.Run("Urlencoded body", func(t *testing.T) {
+		body := "name=Ada+Lovelace&tag=b&tag=c%26d"
+		r, err := RequestFromReader(strings.NewReader("POST /submit?tag=a&page=2 HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded; charset=utf-8\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+		require.NoError(t, err)
+
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "Ada Lovelace", r.FormValue("name"))
+		assert.Equal(t, "2", r.FormValue("page"))
+		assert.Equal(t, []string{"b", "c&d", "a"}, r.Form["tag"])
+		assert.Equal(t, []string{"b", "c&d"}, r.PostForm["tag"])
+		assert.Empty(t, r.PostForm.Get("page"))
+	})
+
+	t.Run("Body ignored for GET", func(t *testing.T) {
+		r, err := RequestFromReader(strings.NewReader("GET /?q=x HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 3\r\n\r\na=b"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "x", r.FormValue("q"))
+		assert.Empty(t, r.FormValue("a"))
+	})
+
+	t.Run("Invalid urlencoded body", func(t *testing.T) {
+		r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 4\r\n\r\na=%z"))
+		require.NoError(t, err)
+		assert.Error(t, r.ParseForm())
+
+		// The body is gone, so the error has to be remembered
+		assert.Empty(t, r.FormValue("a"))
+		assert.Error(t, r.ParseForm())
+		assert.Nil(t, r.PostForm)
+	})
+
+	t.Run("Not multipart", func(t *testing.T) {
+		r := NewRequest("POST", "/", strings.NewReader("a=b"))
+		r.Headers.Set("Content-Type", "application/x-www-form-urlencoded")
+		assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{}), ErrNotForm)
+
+		r.Headers.Set("Content-Type", "multipart/form-data")
+		assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{}), ErrNotForm)
+	})
+}
+
+const testMultipartBody = "preamble to ignore\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"Hello\r\nWorld\r\n" +
+	"--xyz \t\r\n" +
+	"Content-Disposition: form-data; name=\"upload\"; filename=\"../../notes.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"line one\r\n--xy not a boundary\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"Again\r\n" +
+	"--xyz--\r\n" +
+	"epilogue to ignore"
+
+func newMultipartRequest(body string, bytesPerRead int) *Request {
+	r := NewRequest("POST", "/upload?title=query", &chunkReader{data: body, numBytesPerRead: bytesPerRead})
+	r.Headers.Set("Content-Type", `multipart/form-data; boundary="xyz"`)
+	return r
+}
+
+func TestMultipart(t *testing.T) {
+	t.Run("Streaming parts", func(t *testing.T) {
+		for _, bytesPerRead := range []int{1, 3, 7, 1024} {
+			mr, err := newMultipartRequest(testMultipartBody, bytesPerRead).MultipartReader()
+			require.NoError(t, err)
+
+			part, err := mr.NextPart()
+			require.NoError(t, err)
+			assert.Equal(t, "title", part.FormName())
+			assert.Empty(t, part.FileName())
+			data, err := io.ReadAll(part)
+			require.NoError(t, err)
+			assert.Equal(t, "Hello\r\nWorld", string(data))
+
+			part, err = mr.NextPart()
+			require.NoError(t, err)
+			assert.Equal(t, "upload", part.FormName())
+			assert.Equal(t, "notes.txt", part.FileName())
+			contentType, _ := part.Headers.Get("Content-Type")
+			assert.Equal(t, "text/plain", contentType)
+			data, err = io.ReadAll(part)
+			require.NoError(t, err)
+			assert.Equal(t, "line one\r\n--xy not a boundary", string(data))
+
+			// The last part is skipped without being read
+			_, err = mr.NextPart()
+			require.NoError(t, err)
+			_, err = mr.NextPart()
+			assert.ErrorIs(t, err, io.EOF)
+			_, err = mr.NextPart()
+			assert.ErrorIs(t, err, io.EOF)
+		}
+	})
+
+	t.Run("Parse multipart form", func(t *testing.T) {
+		r := newMultipartRequest(testMultipartBody, 5)
+		assert.Equal(t, "Hello\r\nWorld", r.FormValue("title"))
+		assert.Equal(t, []string{"Hello\r\nWorld", "Again", "query"}, r.Form["title"])
+		assert.Equal(t, []string{"Hello\r\nWorld", "Again"}, r.PostForm["title"])
+
+		require.NotNil(t, r.MultipartForm)
+		files := r.MultipartForm.File["upload"]
+		require.Len(t, files, 1)
+		assert.Equal(t, "notes.txt", files[0].Filename)
+		assert.Equal(t, int64(29), files[0].Size)
+
+		f, err := files[0].Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "line one\r\n--xy not a boundary", string(data))
+		require.NoError(t, f.Close())
+	})
+
+	t.Run("Spool large files", func(t *testing.T) {
+		dir := t.TempDir()
+		r := newMultipartRequest(testMultipartBody, 64)
+		require.NoError(t, r.ParseMultipartForm(MultipartLimits{MaxMemory: 16, TempDir: dir}))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		f, err := r.MultipartForm.File["upload"][0].Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "line one\r\n--xy not a boundary", string(data))
+		require.NoError(t, f.Close())
+
+		require.NoError(t, r.MultipartForm.RemoveAll())
+		entries, err = os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		r := newMultipartRequest(testMultipartBody, 64)
+		assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{MaxParts: 2}), ErrTooManyParts)
+
+		dir := t.TempDir()
+		r = newMultipartRequest(testMultipartBody, 64)
+		assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{MaxFileBytes: 10, MaxMemory: 4, TempDir: dir}), ErrPartTooLarge)
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+
+		r = newMultipartRequest(testMultipartBody, 64)
+		assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{MaxMemory: 8}), ErrPartTooLarge)
+	})
+
+	t.Run("Truncated body", func(t *testing.T) {
+		r := newMultipartRequest(testMultipartBody[:60], 8)
+		assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{}), io.ErrUnexpectedEOF)
+	})
+}
@@ -0,0 +1,190 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TargetForm is which of the four request-target forms of RFC 9112 section 3.2
+// a request used.
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path with an optional query, e.g.
+	// "/users?id=1". It is what almost every request uses.
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI, e.g. "http://example.com/users", sent to
+	// proxies.
+	AbsoluteForm
+	// AuthorityForm is host:port, only used by CONNECT.
+	AuthorityForm
+	// AsteriskForm is "*", only used by a server-wide OPTIONS.
+	AsteriskForm
+)
+
+// ErrInvalidTarget is returned for a request-target that is malformed, has bad
+// percent-encoding or does not fit the request method.
+var ErrInvalidTarget = errors.New("invalid request target")
+
+// Target is a parsed request-target.
+type Target struct {
+	Form TargetForm
+	// Scheme is set for the absolute form only
+	Scheme string
+	// Host is host[:port] for the absolute and authority forms
+	Host string
+	// Path has percent-encoding decoded, e.g. "/a b" for "/a%20b". It is "*" for
+	// the asterisk form and empty for the authority form.
+	Path string
+	// RawPath is the path as it was sent, still percent-encoded. Use it when the
+	// difference between "/" and "%2F" matters.
+	RawPath string
+	// RawQuery is the query without the leading "?", still percent-encoded
+	RawQuery string
+
+	query url.Values
+}
+
+// Query returns the decoded query parameters. A parameter may appear several
+// times, in which case all of its values are kept in order.
+func (t Target) Query() url.Values {
+	if t.query == nil {
+		return url.Values{}
+	}
+	return t.query
+}
+
+// ParseTarget parses the request-target of a request with method. CONNECT
+// requests must use the authority form and only OPTIONS may use the asterisk
+// form.
+func ParseTarget(method, target string) (Target, error) {
+	for i := range len(target) {
+		if c := target[i]; c <= ' ' || c >= 0x7f || c == '#' {
+			return Target{}, fmt.Errorf("%w: invalid character %q in %q", ErrInvalidTarget, c, target)
+		}
+	}
+
+	switch {
+	case method == "CONNECT":
+		return parseAuthorityForm(target)
+	case target == "*":
+		if method != "OPTIONS" {
+			return Target{}, fmt.Errorf("%w: * is only allowed for OPTIONS", ErrInvalidTarget)
+		}
+		return Target{Form: AsteriskForm, Path: "*", RawPath: "*"}, nil
+	case strings.HasPrefix(target, "/"):
+		t := Target{Form: OriginForm}
+		if err := t.parsePathAndQuery(target); err != nil {
+			return Target{}, err
+		}
+		return t, nil
+	default:
+		return parseAbsoluteForm(target)
+	}
+}
+
+func parseAuthorityForm(target string) (Target, error) {
+	// The host may be an IPv6 literal in brackets, full of colons itself
+	i := strings.LastIndexByte(target, ':')
+	if i <= 0 || i == len(target)-1 || strings.ContainsAny(target, "/?@") {
+		return Target{}, fmt.Errorf("%w: CONNECT needs host:port, got %q", ErrInvalidTarget, target)
+	}
+	port := target[i+1:]
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return Target{}, fmt.Errorf("%w: invalid port in %q", ErrInvalidTarget, target)
+		}
+	}
+	return Target{Form: AuthorityForm, Host: target}, nil
+}
+
+func parseAbsoluteForm(target string) (Target, error) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !isValidScheme(scheme) {
+		return Target{}, fmt.Errorf("%w: %q is not a path or absolute URI", ErrInvalidTarget, target)
+	}
+
+	end := strings.IndexAny(rest, "/?")
+	if end == -1 {
+		end = len(rest)
+	}
+	t := Target{
+		Form:   AbsoluteForm,
+		Scheme: strings.ToLower(scheme),
+		Host:   rest[:end],
+	}
+	if t.Host == "" || strings.Contains(t.Host, "@") {
+		return Target{}, fmt.Errorf("%w: invalid host in %q", ErrInvalidTarget, target)
+	}
+
+	// An empty path means the root
+	pathAndQuery := rest[end:]
+	if !strings.HasPrefix(pathAndQuery, "/") {
+		pathAndQuery = "/" + pathAndQuery
+	}
+	if err := t.parsePathAndQuery(pathAndQuery); err != nil {
+		return Target{}, err
+	}
+	return t, nil
+}
+
+func (t *Target) parsePathAndQuery(s string) error {
+	rawPath, rawQuery, _ := strings.Cut(s, "?")
+
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	query, err := parseQuery(rawQuery)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+
+	t.Path = path
+	t.RawPath = rawPath
+	t.RawQuery = rawQuery
+	t.query = query
+	return nil
+}
+
+// parseQuery decodes a query string. Unlike url.ParseQuery it accepts ";" as
+// part of a value, but bad percent-encoding is still an error.
+func parseQuery(rawQuery string) (url.Values, error) {
+	query := url.Values{}
+	for param := range strings.SplitSeq(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		rawKey, rawValue, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			return nil, err
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return nil, err
+		}
+		query[key] = append(query[key], value)
+	}
+	return query, nil
+}
+
+func isValidScheme(scheme string) bool {
+	if scheme == "" || !isLetter(scheme[0]) {
+		return false
+	}
+	for i := 1; i < len(scheme); i++ {
+		c := scheme[i]
+		if !isLetter(c) && !isDigit(c) && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,38 @@
+package request
+
+import "crypto/x509"
+
+// ClientCertificate returns the client certificate the server verified during
+// the TLS handshake, or nil if the client sent none or the connection is not
+// TLS. Certificates the server did not verify against its CA pool are never
+// returned.
+func (r *Request) ClientCertificate() *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// ClientIdentities returns the names the verified client certificate vouches
+// for: its subject common name followed by its DNS, URI, email and IP subject
+// alternative names. It is empty if there is no verified certificate.
+func (r *Request) ClientIdentities() []string {
+	cert := r.ClientCertificate()
+	if cert == nil {
+		return nil
+	}
+
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	ids = append(ids, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		ids = append(ids, ip.String())
+	}
+	return ids
+}
@@ -0,0 +1,302 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+)
+
+// Content codings the Writer can compress bodies with, in the order they are
+// preferred when a client accepts several equally.
+const (
+	EncodingBrotli  = "br"
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+var supportedEncodings = []string{EncodingBrotli, EncodingGzip, EncodingDeflate}
+
+// DefaultMinCompressSize is the body size below which compression is not
+// worth its overhead.
+const DefaultMinCompressSize = 1024
+
+// incompressibleTypes are media types whose content is compressed already, so
+// compressing it again only costs time. Whole top-level types end in "/".
+var incompressibleTypes = []string{
+	"image/",
+	"audio/",
+	"video/",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"multipart/byteranges",
+}
+
+// encoder compresses a body. Flush pushes out what has been written so far, so
+// streamed bodies keep flowing.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(encoding string, dst io.Writer) encoder {
+	switch encoding {
+	case EncodingBrotli:
+		return brotli.NewWriterLevel(dst, brotli.DefaultCompression)
+	case EncodingGzip:
+		return gzip.NewWriter(dst)
+	case EncodingDeflate:
+		// HTTP's deflate is the zlib format, not a raw deflate stream
+		return zlib.NewWriter(dst)
+	}
+	return nil
+}
+
+// NegotiateEncoding picks the content coding to compress a response with from
+// a request's Accept-Encoding value, honouring q-values and "*". Ties go to
+// the order of EncodingBrotli, EncodingGzip and EncodingDeflate. It returns ""
+// if the body should be sent as it is, including when the header is missing.
+func NegotiateEncoding(acceptEncoding string) string {
+	weights := make(map[string]float64)
+	wildcard := -1.0
+
+	for item := range strings.SplitSeq(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(item, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		// x-gzip is an alias kept for old clients
+		if coding == "x-gzip" {
+			coding = EncodingGzip
+		}
+		weights[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supportedEncodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q = max(wildcard, 0)
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// SetCompression has the Writer compress the body with encoding, as returned
+// by NegotiateEncoding, where that is worthwhile: not for bodies shorter than
+// minSize bytes (DefaultMinCompressSize if zero), media types that are
+// compressed already, partial content or bodies with a Content-Encoding of
+// their own.
+//
+// Bodies written with Write get a Content-Length for their compressed size.
+// Streamed bodies are compressed as they are written and sent chunked, even if
+// the handler declared a Content-Length. Compressed responses get
+// Content-Encoding, strong ETags are made weak as they no longer match the
+// bytes sent, and Accept-Ranges is dropped. Every response that could have been
+// compressed gets Vary: Accept-Encoding, whatever the encoding, so caches keep
+// the variants apart.
+func (w *Writer) SetCompression(encoding string, minSize int) {
+	if minSize <= 0 {
+		minSize = DefaultMinCompressSize
+	}
+	w.compress = true
+	w.encoding = ""
+	if slices.Contains(supportedEncodings, encoding) {
+		w.encoding = encoding
+	}
+	w.minCompressSize = minSize
+}
+
+// compressBody compresses a whole body about to be written with Write,
+// updating h to match. Bodies that are not compressed are returned unchanged.
+func (w *Writer) compressBody(statusCode StatusCode, h *headers.Headers, body []byte) []byte {
+	if !w.compress || !w.compressible(statusCode, h) {
+		return body
+	}
+	w.addVary(h)
+	if w.encoding == "" || len(body) < w.minCompressSize {
+		return body
+	}
+
+	var buf bytes.Buffer
+	enc := newEncoder(w.encoding, &buf)
+	if _, err := enc.Write(body); err != nil {
+		log.Printf("Error: could not compress response body: %v", err)
+		return body
+	}
+	if err := enc.Close(); err != nil {
+		log.Printf("Error: could not compress response body: %v", err)
+		return body
+	}
+
+	w.markEncoded(h)
+	return buf.Bytes()
+}
+
+// prepareStream sets up compression of a body that is about to be streamed,
+// returning the headers to send in place of h.
+func (w *Writer) prepareStream(h *headers.Headers) *headers.Headers {
+	if !w.compress || !w.compressible(w.statusCode, h) {
+		return h
+	}
+	h = h.Clone()
+	w.addVary(h)
+	if w.encoding == "" {
+		return h
+	}
+	if val, ok := h.Get("Content-Length"); ok {
+		if length, err := strconv.Atoi(val); err == nil && length < w.minCompressSize {
+			return h
+		}
+	}
+
+	h.Del("Content-Length")
+	if !h.HasToken("Transfer-Encoding", "chunked") {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+	w.markEncoded(h)
+	w.encoder = newEncoder(w.encoding, chunkSink{w})
+	return h
+}
+
+// compressible reports whether a response could be compressed, whatever the
+// client accepts.
+func (w *Writer) compressible(statusCode StatusCode, h *headers.Headers) bool {
+	if !statusCode.allowsBody() || statusCode == StatusPartialContent {
+		return false
+	}
+	if _, ok := w.field(h, "Content-Range"); ok {
+		return false
+	}
+	if encoding, ok := w.field(h, "Content-Encoding"); ok && !strings.EqualFold(strings.TrimSpace(encoding), "identity") {
+		return false
+	}
+
+	contentType, _ := w.field(h, "Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// An unknown type is most likely text
+		return contentType == ""
+	}
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, incompressible := range incompressibleTypes {
+		if mediaType == incompressible || (strings.HasSuffix(incompressible, "/") && strings.HasPrefix(mediaType, incompressible)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *Writer) addVary(h *headers.Headers) {
+	vary, ok := w.field(h, "Vary")
+	switch {
+	case !ok:
+		h.Set("Vary", "Accept-Encoding")
+	case strings.TrimSpace(vary) == "*":
+	default:
+		for name := range strings.SplitSeq(vary, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Accept-Encoding") {
+				return
+			}
+		}
+		h.Override("Vary", vary+", Accept-Encoding")
+	}
+}
+
+// markEncoded updates h for a body compressed with the Writer's encoding.
+func (w *Writer) markEncoded(h *headers.Headers) {
+	h.Override("Content-Encoding", w.encoding)
+	h.Del("Accept-Ranges")
+	if etag, ok := w.field(h, "ETag"); ok && strings.HasPrefix(etag, `"`) {
+		h.Override("ETag", "W/"+etag)
+	}
+}
+
+// field returns a header field as it will be written: from h, or else from
+// the fields added with Header.
+func (w *Writer) field(h *headers.Headers, key string) (string, bool) {
+	if val, ok := h.Get(key); ok {
+		return val, true
+	}
+	if w.header != nil {
+		return w.header.Get(key)
+	}
+	return "", false
+}
+
+// chunkSink sends what the encoder produces as chunks of the body.
+type chunkSink struct {
+	w *Writer
+}
+
+func (s chunkSink) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := s.w.writeChunk(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeEncoded compresses p into the body, flushing the encoder so the client
+// gets it without waiting for more.
+func (w *Writer) writeEncoded(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := w.encoder.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.encoder.Flush()
+}
+
+// closeEncoder writes out the end of the compressed body.
+func (w *Writer) closeEncoder() error {
+	enc := w.encoder
+	w.encoder = nil
+	return enc.Close()
+}
@@ -0,0 +1,155 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+)
+
+// StrongETag returns a strong entity-tag for content, derived from its SHA-256
+// hash, so it changes whenever a single byte does.
+func StrongETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// WeakETag returns a weak entity-tag derived from a modification time and
+// size, e.g. for files that would be too costly to hash on every request.
+func WeakETag(modTime time.Time, size int64) string {
+	return `W/"` + strconv.FormatInt(modTime.UnixNano(), 16) + "-" + strconv.FormatInt(size, 16) + `"`
+}
+
+// CheckPreconditions evaluates the conditional headers of a request with
+// method against the current representation of the resource, in the order of
+// RFC 9110 section 13.2.2. etag and lastModified describe the representation
+// and may be left empty or zero if unknown; the resource is assumed to exist,
+// so "*" always matches.
+//
+// It returns StatusOK if the request should go ahead, StatusNotModified if a
+// GET or HEAD can be answered with a 304 and StatusPreconditionFailed if the
+// request must be refused with a 412.
+func CheckPreconditions(method string, reqHeaders *headers.Headers, etag string, lastModified time.Time) StatusCode {
+	lastModified = lastModified.Truncate(time.Second)
+	safe := method == "GET" || method == "HEAD"
+
+	if ifMatch, ok := reqHeaders.Get("If-Match"); ok {
+		if !matchETag(ifMatch, etag, false) {
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := headerTime(reqHeaders, "If-Unmodified-Since"); ok && !lastModified.IsZero() {
+		if lastModified.After(since) {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch, ok := reqHeaders.Get("If-None-Match"); ok {
+		if !matchETag(ifNoneMatch, etag, true) {
+			return StatusOK
+		}
+		if safe {
+			return StatusNotModified
+		}
+		return StatusPreconditionFailed
+	}
+
+	if since, ok := headerTime(reqHeaders, "If-Modified-Since"); ok && safe && !lastModified.IsZero() {
+		if !lastModified.After(since) {
+			return StatusNotModified
+		}
+	}
+	return StatusOK
+}
+
+// WriteConditional checks the request's preconditions with CheckPreconditions
+// and, if they fail, answers it with a 304 or 412. It reports whether it did,
+// in which case the handler has nothing left to write. A 304 repeats the
+// ETag and Last-Modified a 200 would have carried.
+func WriteConditional(w *Writer, method string, reqHeaders *headers.Headers, etag string, lastModified time.Time) bool {
+	statusCode := CheckPreconditions(method, reqHeaders, etag, lastModified)
+	switch statusCode {
+	case StatusNotModified:
+		h := headers.NewHeaders()
+		if etag != "" {
+			h.Set("ETag", etag)
+		}
+		if !lastModified.IsZero() {
+			h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+		}
+		_ = Write(w, statusCode, h, nil)
+		return true
+	case StatusPreconditionFailed:
+		_ = Write(w, statusCode, GetDefaultHeaders(), []byte(StatusText(statusCode)))
+		return true
+	}
+	return false
+}
+
+// matchETag reports whether etag is in the list of entity-tags of an If-Match
+// or If-None-Match value, or the list is "*". The weak comparison of
+// If-None-Match ignores the W/ prefix, while the strong one of If-Match never
+// matches weak tags.
+func matchETag(list, etag string, weak bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return false
+		}
+
+		tag, rest, ok := cutETag(list)
+		if !ok {
+			// A malformed list cannot match anything after this point
+			return false
+		}
+		list = rest
+
+		if weak {
+			if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if !strings.HasPrefix(tag, "W/") && tag == etag {
+			return true
+		}
+	}
+}
+
+// cutETag splits the entity-tag at the start of s from the rest. Tags are
+// quoted and may contain commas, so the list cannot simply be split on them.
+func cutETag(s string) (tag, rest string, ok bool) {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return "", "", false
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end == -1 {
+		return "", "", false
+	}
+	end += start + 2
+	return s[:end], s[end:], true
+}
+
+// headerTime parses an HTTP-date header. Missing and invalid dates both report
+// false, as the RFC has invalid ones ignored.
+func headerTime(h *headers.Headers, key string) (time.Time, bool) {
+	value, ok := h.Get(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(strings.TrimSpace(value))
+	return t, err == nil
+}
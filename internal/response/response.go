@@ -2,68 +2,391 @@
 package response
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"strconv"
 
 	"github.com/bailey4770/httpfromtcp/internal/headers"
 )
 
+type writerState int
+
+const (
+	writingStatusLine writerState = iota
+	writingHeaders
+	writingBody
+	writingTrailers
+	doneWriting
+)
+
+// bodyMode is how the end of the body is signalled to the client, decided by
+// the headers that were written.
+type bodyMode int
+
+const (
+	bodyNone bodyMode = iota
+	bodyContentLength
+	bodyChunked
+	bodyUntilClose
+)
+
+var (
+	// ErrWriteOrder is returned when part of the response is written out of the
+	// status line -> headers -> body -> trailers order, or written twice.
+	ErrWriteOrder = errors.New("response written out of order")
+	// ErrBodyNotAllowed is returned when writing a body for a status that cannot
+	// have one, such as 204 or 304.
+	ErrBodyNotAllowed = errors.New("response status does not allow a body")
+	// ErrContentLength is returned when a body does not match its Content-Length.
+	ErrContentLength = errors.New("response body does not match Content-Length")
+)
+
+// Writer writes a single response to a connection. It tracks how far the
+// response has got and rejects writes that would break its framing.
 type Writer struct {
-	Conn net.Conn
+	dst io.Writer
+	// header holds fields added to the header block on top of the handler's
+	header *headers.Headers
+
+	state     writerState
+	mode      bodyMode
+	bodyless  bool
+	remaining int64
+	closeConn bool
+	aborted   bool
+	// http10 is set for HTTP/1.0 clients, which cannot decode chunked bodies
+	// and need keep-alive spelled out
+	http10 bool
+	// dechunk is set when a chunked response is sent unframed to an HTTP/1.0
+	// client
+	dechunk bool
+	// head is set for HEAD requests, whose responses carry the headers of the
+	// equivalent GET but no body
+	head bool
+	// compress is set by SetCompression, encoding is empty when the client
+	// accepts no supported coding
+	compress        bool
+	encoding        string
+	minCompressSize int
+	// encoder compresses a streamed body into chunks
+	encoder    encoder
+	statusCode StatusCode
+	bodyBytes  int64
+}
+
+// NewWriter returns a Writer for one response written to dst, usually the
+// net.Conn the request arrived on.
+func NewWriter(dst io.Writer) *Writer {
+	return &Writer{dst: dst}
+}
+
+// CloseConnection marks the connection to be closed once this response has
+// been written. If the header block has not been sent yet, Connection: close is
+// added to it so the client knows not to reuse the connection.
+func (w *Writer) CloseConnection() {
+	w.closeConn = true
+}
+
+// SetRequestVersion tells the Writer which HTTP version the request used. For
+// HTTP/1.0 clients, responses with Transfer-Encoding: chunked are sent without
+// it, ending the body by closing the connection and dropping any trailers, and
+// a connection kept alive is announced with Connection: keep-alive.
+func (w *Writer) SetRequestVersion(major, minor int) {
+	w.http10 = major == 1 && minor == 0
 }
 
-func Write(w *Writer, statusCode StatusCode, headers headers.Headers, body []byte) {
-	headers.Set("Content-Length", strconv.Itoa(len(body)))
+// SetRequestMethod tells the Writer which method the request used. Responses
+// to HEAD are sent without a body: the headers, Content-Length included, are
+// written as they are, and body writes are accepted but discarded.
+func (w *Writer) SetRequestMethod(method string) {
+	w.head = method == "HEAD"
+}
+
+// Header returns fields that are added to the header block when it is written,
+// which lets middleware set headers on responses written by the handler it
+// wraps. Fields the handler writes under the same name take precedence. Changes
+// after the header block has been written have no effect.
+func (w *Writer) Header() *headers.Headers {
+	if w.header == nil {
+		w.header = headers.NewHeaders()
+	}
+	return w.header
+}
+
+// Abort gives up on a response that has already started, for example because
+// the handler writing it panicked. Nothing more can be written and the
+// connection is closed, so the client sees a truncated response instead of one
+// that looks complete.
+func (w *Writer) Abort() {
+	w.aborted = true
+	w.closeConn = true
+	w.state = doneWriting
+}
+
+// StatusCode returns the status code written, or 0 if there is none yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BodyBytes returns the number of body bytes written so far, after any
+// compression and not counting chunked framing.
+func (w *Writer) BodyBytes() int64 {
+	return w.bodyBytes
+}
+
+// Started reports whether any part of the response has been written.
+func (w *Writer) Started() bool {
+	return w.state != writingStatusLine
+}
+
+// Done reports whether the response has been written in full.
+func (w *Writer) Done() bool {
+	return w.state == doneWriting && !w.aborted
+}
+
+// KeepAlive reports whether the response was fully framed and neither side asked
+// for the connection to be closed, meaning another request can be read from it.
+func (w *Writer) KeepAlive() bool {
+	return w.state == doneWriting && !w.closeConn
+}
 
-	if err := w.writeStatusLine(statusCode); err != nil {
+// Write sends a complete response with body, setting Content-Length to match.
+func Write(w *Writer, statusCode StatusCode, headers *headers.Headers, body []byte) error {
+	if statusCode.allowsBody() {
+		body = w.compressBody(statusCode, headers, body)
+		headers.Override("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	if err := w.WriteStatusLine(statusCode); err != nil {
 		log.Printf("Error: could not write error status line to writer: %v", err)
+		return err
 	}
-	if err := w.writeHeaders(headers); err != nil {
+	if err := w.WriteHeaders(headers); err != nil {
 		log.Printf("Error: could not write error headers to writer: %v", err)
+		return err
 	}
-	if _, err := w.writeBody(body); err != nil {
+	if _, err := w.Write(body); err != nil {
 		log.Printf("Error: could not write error body to writer: %v", err)
+		return err
 	}
+	return nil
 }
 
-func GetDefaultHeaders() headers.Headers {
+func GetDefaultHeaders() *headers.Headers {
 	headers := headers.NewHeaders()
 
-	headers.Set("Connection", "close")
 	headers.Set("Content-Type", "text/plain")
 
 	return headers
 }
 
-func StartStream(w *Writer, statusCode StatusCode, headers headers.Headers) {
-	if err := w.writeStatusLine(statusCode); err != nil {
+// StartStream writes the status line and headers, leaving the body to be
+// written with Write or WriteChunkedBody.
+func StartStream(w *Writer, statusCode StatusCode, headers *headers.Headers) error {
+	if err := w.WriteStatusLine(statusCode); err != nil {
 		log.Printf("Error: could not write error status line to writer: %v", err)
+		return err
 	}
-	if err := w.writeHeaders(headers); err != nil {
+	if err := w.WriteHeaders(headers); err != nil {
 		log.Printf("Error: could not write error headers to writer: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.state != writingStatusLine {
+		return fmt.Errorf("%w: status line already written", ErrWriteOrder)
+	}
+	if !statusCode.valid() {
+		return fmt.Errorf("invalid status code %d: must be three digits", statusCode)
+	}
+	w.state = writingHeaders
+	w.statusCode = statusCode
+	w.bodyless = !statusCode.allowsBody()
+
+	// The reason phrase is optional, unregistered codes just leave it empty
+	msg := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, StatusText(statusCode))
+	_, err := w.dst.Write([]byte(msg))
+	return err
+}
+
+// WriteHeaders writes the header block. Content-Length and Transfer-Encoding
+// decide how the body that follows is framed.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	if w.state != writingHeaders {
+		return fmt.Errorf("%w: headers must follow the status line exactly once", ErrWriteOrder)
+	}
+
+	h = w.prepareStream(h)
+	if err := w.setBodyMode(h); err != nil {
+		return err
+	}
+
+	if w.dechunk {
+		h = h.Clone()
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+	}
+
+	if h.HasToken("Connection", "close") {
+		w.closeConn = true
+	} else if w.closeConn {
+		if _, err := w.dst.Write([]byte("Connection: close\r\n")); err != nil {
+			return err
+		}
+	} else if w.http10 && !h.HasToken("Connection", "keep-alive") {
+		if _, err := w.dst.Write([]byte("Connection: keep-alive\r\n")); err != nil {
+			return err
+		}
+	}
+
+	w.state = writingBody
+	if w.mode == bodyNone || (w.mode == bodyContentLength && w.remaining == 0) {
+		w.state = doneWriting
+	}
+
+	if w.header != nil {
+		for key, value := range w.header.All() {
+			if _, ok := h.Get(key); ok {
+				continue
+			}
+			if _, err := w.dst.Write([]byte(key + ": " + value + "\r\n")); err != nil {
+				return err
+			}
+		}
 	}
+
+	return w.writeFields(h)
+}
+
+// setBodyMode works out the body framing from the headers about to be written.
+func (w *Writer) setBodyMode(h *headers.Headers) error {
+	if w.bodyless || w.head {
+		w.mode = bodyNone
+		return nil
+	}
+
+	switch {
+	case h.HasToken("Transfer-Encoding", "chunked") && w.http10:
+		// HTTP/1.0 has no chunked framing, so the body runs until close
+		w.dechunk = true
+		w.mode = bodyUntilClose
+		w.closeConn = true
+	case h.HasToken("Transfer-Encoding", "chunked"):
+		w.mode = bodyChunked
+	case hasContentLength(h):
+		val, _ := h.Get("Content-Length")
+		length, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || length < 0 {
+			return fmt.Errorf("%w: invalid value %q", ErrContentLength, val)
+		}
+		w.mode = bodyContentLength
+		w.remaining = length
+	default:
+		// Without a length or chunked framing the client can only find the end of
+		// the body by the connection closing
+		w.mode = bodyUntilClose
+		w.closeConn = true
+	}
+	return nil
+}
+
+// Write writes p as (part of) the body. With chunked framing each call sends one
+// chunk, otherwise p is written as is and checked against Content-Length.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.discarding() {
+		return len(p), nil
+	}
+	if w.encoder != nil && w.state == writingBody {
+		return w.writeEncoded(p)
+	}
+	if w.state == writingBody && w.mode == bodyChunked {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if _, err := w.WriteChunkedBody(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	if err := w.checkBodyWrite(int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	n, err := w.writeBody(p)
+	w.bodyBytes += int64(n)
+	if w.mode == bodyContentLength {
+		w.remaining -= int64(n)
+		if w.remaining == 0 {
+			w.state = doneWriting
+		}
+	}
+	return n, err
+}
+
+// checkBodyWrite reports whether n more bytes of unchunked body may be written.
+func (w *Writer) checkBodyWrite(n int64) error {
+	switch {
+	case w.state == doneWriting && w.mode == bodyNone:
+		if n == 0 {
+			return nil
+		}
+		return ErrBodyNotAllowed
+	case w.state == doneWriting && w.mode == bodyContentLength:
+		if n == 0 {
+			return nil
+		}
+		return fmt.Errorf("%w: body is longer than declared", ErrContentLength)
+	case w.state != writingBody:
+		return fmt.Errorf("%w: body must follow the headers", ErrWriteOrder)
+	case w.mode == bodyContentLength && n > w.remaining:
+		return fmt.Errorf("%w: body is longer than declared", ErrContentLength)
+	}
+	return nil
 }
 
 func (w *Writer) WriteChunkedBody(chunk []byte) (int, error) {
+	if w.discarding() {
+		return len(chunk), nil
+	}
+	if w.encoder != nil && w.state == writingBody {
+		return w.writeEncoded(chunk)
+	}
+	return w.writeChunk(chunk)
+}
+
+// writeChunk sends chunk as it is, framed unless the client is HTTP/1.0.
+func (w *Writer) writeChunk(chunk []byte) (int, error) {
+	if w.dechunk && w.state == writingBody {
+		n, err := w.writeBody(chunk)
+		w.bodyBytes += int64(n)
+		return n, err
+	}
+	if w.state != writingBody || w.mode != bodyChunked {
+		return 0, fmt.Errorf("%w: chunks need Transfer-Encoding: chunked headers and must come before the last chunk", ErrWriteOrder)
+	}
 	total := 0
 
-	n, err := fmt.Fprintf(w.Conn, "%x\r\n", len(chunk))
+	n, err := fmt.Fprintf(w.dst, "%x\r\n", len(chunk))
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	total += n
 
 	n, err = w.writeBody(chunk)
+	w.bodyBytes += int64(n)
 	if err != nil {
 		return 0, err
 	}
 	total += n
 
-	n, err = fmt.Fprint(w.Conn, "\r\n")
+	n, err = fmt.Fprint(w.dst, "\r\n")
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	total += n
 
@@ -71,58 +394,115 @@ func (w *Writer) WriteChunkedBody(chunk []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.discarding() {
+		return 0, nil
+	}
+	if w.encoder != nil && w.state == writingBody {
+		if err := w.closeEncoder(); err != nil {
+			return 0, err
+		}
+	}
+	if w.dechunk && w.state == writingBody {
+		w.state = writingTrailers
+		return 0, nil
+	}
+	if w.state != writingBody || w.mode != bodyChunked {
+		return 0, fmt.Errorf("%w: last chunk needs Transfer-Encoding: chunked headers and can only be written once", ErrWriteOrder)
+	}
+
 	n, err := w.writeBody([]byte("0\r\n"))
 	if err != nil {
 		return 0, err
 	}
+	w.state = writingTrailers
 
 	return n, nil
 }
 
-type StatusCode int
-
-const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
-)
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	if w.discarding() {
+		return nil
+	}
+	if w.state != writingTrailers {
+		return fmt.Errorf("%w: trailers must follow the last chunk", ErrWriteOrder)
+	}
+	if w.dechunk {
+		w.state = doneWriting
+		return nil
+	}
 
-func (w *Writer) writeStatusLine(statusCode StatusCode) error {
-	switch statusCode {
-	case 200:
-		_, err := w.Conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		return err
-	case 400:
-		_, err := w.Conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-		return err
-	case 500:
-		_, err := w.Conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n"))
-		return err
-	default:
-		msg := fmt.Sprintf("HTTP/1.1 %d \r\n", statusCode)
-		_, err := w.Conn.Write([]byte(msg))
+	if err := w.writeFields(h); err != nil {
 		return err
 	}
+	w.state = doneWriting
+	return nil
+}
+
+// Finish completes a response the handler left open where that can be done
+// without guessing at its content: a chunked body gets its last chunk and an
+// empty trailer section. A Content-Length body that fell short cannot be
+// completed, so the connection is marked to be closed and an error returned.
+func (w *Writer) Finish() error {
+	if w.aborted {
+		return nil
+	}
+
+	switch w.state {
+	case writingStatusLine, writingHeaders:
+		w.closeConn = true
+		return fmt.Errorf("%w: response has no headers", ErrWriteOrder)
+
+	case writingBody:
+		switch w.mode {
+		case bodyChunked:
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return err
+			}
+			return w.WriteTrailers(headers.NewHeaders())
+		case bodyContentLength:
+			w.closeConn = true
+			return fmt.Errorf("%w: %d bytes short", ErrContentLength, w.remaining)
+		default:
+			// Closing the connection is what ends this body
+			if w.encoder != nil {
+				if err := w.closeEncoder(); err != nil {
+					return err
+				}
+			}
+			w.state = doneWriting
+			return nil
+		}
+
+	case writingTrailers:
+		return w.WriteTrailers(headers.NewHeaders())
+	}
+	return nil
+}
+
+// discarding reports whether body writes are dropped because the response is
+// to a HEAD request.
+func (w *Writer) discarding() bool {
+	return w.head && w.state == doneWriting && !w.aborted
 }
 
-func (w *Writer) writeHeaders(h headers.Headers) error {
-	for key, value := range h {
-		cononicalKey := headers.CanonicalHeaderKey(key)
-		header := cononicalKey + ": " + value + "\r\n"
-		if _, err := w.Conn.Write([]byte(header)); err != nil {
+func (w *Writer) writeFields(h *headers.Headers) error {
+	for key, value := range h.All() {
+		header := key + ": " + value + "\r\n"
+		if _, err := w.dst.Write([]byte(header)); err != nil {
 			return err
 		}
 	}
 
-	_, err := w.Conn.Write([]byte("\r\n"))
+	_, err := w.dst.Write([]byte("\r\n"))
 	return err
 }
 
 func (w *Writer) writeBody(body []byte) (int, error) {
-	n, err := w.Conn.Write([]byte(body))
+	n, err := w.dst.Write([]byte(body))
 	return n, err
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
-	return w.writeHeaders(h)
+func hasContentLength(h *headers.Headers) bool {
+	_, ok := h.Get("Content-Length")
+	return ok
 }
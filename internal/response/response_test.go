@@ -0,0 +1,580 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusLine(t *testing.T) {
+	t.Run("Registered codes have reason phrases", func(t *testing.T) {
+		assert.Equal(t, "Not Found", StatusText(StatusNotFound))
+		assert.Equal(t, "Service Unavailable", StatusText(StatusServiceUnavailable))
+		assert.Equal(t, "No Content", StatusText(StatusNoContent))
+		assert.Equal(t, "", StatusText(299))
+	})
+
+	t.Run("Status line uses reason phrase", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		require.NoError(t, w.WriteStatusLine(StatusMethodNotAllowed))
+		assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\n", conn.String())
+	})
+
+	t.Run("Unregistered code has empty reason", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		require.NoError(t, w.WriteStatusLine(299))
+		assert.Equal(t, "HTTP/1.1 299 \r\n", conn.String())
+	})
+
+	t.Run("Codes outside 100-999 are rejected", func(t *testing.T) {
+		for _, code := range []StatusCode{0, 99, 1000, -200} {
+			conn := &bytes.Buffer{}
+			w := NewWriter(conn)
+			require.Error(t, w.WriteStatusLine(code))
+			assert.Equal(t, "", conn.String())
+			assert.False(t, w.Started())
+		}
+	})
+}
+
+func TestWriterState(t *testing.T) {
+	t.Run("Headers before status line", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		assert.ErrorIs(t, w.WriteHeaders(headers.NewHeaders()), ErrWriteOrder)
+		assert.False(t, w.Started())
+	})
+
+	t.Run("Body before headers", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		require.NoError(t, w.WriteStatusLine(StatusOK))
+		_, err := w.Write([]byte("hello"))
+		assert.ErrorIs(t, err, ErrWriteOrder)
+	})
+
+	t.Run("StartStream twice", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		assert.ErrorIs(t, StartStream(w, StatusOK, h), ErrWriteOrder)
+	})
+
+	t.Run("Fixed length response", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		require.NoError(t, Write(w, StatusOK, headers.NewHeaders(), []byte("hello")))
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", conn.String())
+		assert.True(t, w.Done())
+		assert.True(t, w.KeepAlive())
+
+		_, err := w.Write([]byte("more"))
+		assert.ErrorIs(t, err, ErrContentLength)
+	})
+
+	t.Run("Body longer than Content-Length", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "3")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.Write([]byte("hello"))
+		assert.ErrorIs(t, err, ErrContentLength)
+	})
+
+	t.Run("No body allowed for 204", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		require.NoError(t, Write(w, StatusNoContent, headers.NewHeaders(), nil))
+		assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", conn.String())
+		assert.True(t, w.KeepAlive())
+
+		_, err := w.Write([]byte("hello"))
+		assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	})
+
+	t.Run("Chunked writes", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		require.NoError(t, StartStream(w, StatusOK, h))
+
+		_, err := w.Write([]byte("hello"))
+		require.NoError(t, err)
+		_, err = w.WriteChunkedBodyDone()
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("late"))
+		assert.ErrorIs(t, err, ErrWriteOrder)
+		_, err = w.WriteChunkedBody([]byte("late"))
+		assert.ErrorIs(t, err, ErrWriteOrder)
+		assert.False(t, w.KeepAlive())
+
+		require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+		assert.True(t, w.KeepAlive())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", conn.String())
+	})
+
+	t.Run("Chunks without chunked headers", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "5")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.WriteChunkedBody([]byte("hello"))
+		assert.ErrorIs(t, err, ErrWriteOrder)
+	})
+
+	t.Run("Finish completes chunked body", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.Write([]byte("hi"))
+		require.NoError(t, err)
+
+		require.NoError(t, w.Finish())
+		assert.True(t, w.KeepAlive())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n", conn.String())
+	})
+
+	t.Run("Finish cannot complete short body", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "5")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.Write([]byte("hi"))
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, w.Finish(), ErrContentLength)
+		assert.False(t, w.KeepAlive())
+	})
+
+	t.Run("Unframed body closes connection", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		require.NoError(t, StartStream(w, StatusOK, headers.NewHeaders()))
+		_, err := w.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		require.NoError(t, w.Finish())
+		assert.False(t, w.KeepAlive())
+	})
+
+	t.Run("Abort leaves chunked body unfinished", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.Write([]byte("hi"))
+		require.NoError(t, err)
+
+		w.Abort()
+		_, err = w.Write([]byte("more"))
+		assert.Error(t, err)
+		require.NoError(t, w.Finish())
+
+		assert.False(t, w.Done())
+		assert.False(t, w.KeepAlive())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n", conn.String())
+	})
+}
+
+func TestWriterHeader(t *testing.T) {
+	t.Run("Extra fields are written with the handler's", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.Header().Set("X-Request-ID", "abc")
+		w.Header().Set("Content-Type", "text/html")
+
+		require.NoError(t, Write(w, StatusOK, GetDefaultHeaders(), []byte("hi")))
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nX-Request-ID: abc\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nhi", conn.String())
+	})
+
+	t.Run("Status and body size are tracked", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		assert.Equal(t, StatusCode(0), w.StatusCode())
+
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		require.NoError(t, StartStream(w, StatusCreated, h))
+		_, err := w.Write([]byte("hello"))
+		require.NoError(t, err)
+		_, err = w.WriteChunkedBody([]byte("world"))
+		require.NoError(t, err)
+
+		assert.Equal(t, StatusCreated, w.StatusCode())
+		assert.Equal(t, int64(10), w.BodyBytes())
+	})
+}
+
+func TestHTTP10(t *testing.T) {
+	t.Run("Chunked response is sent unframed", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetRequestVersion(1, 0)
+
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.SetTrailers("X-Sum")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.WriteChunkedBody([]byte("hello "))
+		require.NoError(t, err)
+		_, err = w.Write([]byte("world"))
+		require.NoError(t, err)
+		_, err = w.WriteChunkedBodyDone()
+		require.NoError(t, err)
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Sum", "abc")
+		require.NoError(t, w.WriteTrailers(trailers))
+
+		assert.True(t, w.Done())
+		assert.False(t, w.KeepAlive())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello world", conn.String())
+	})
+
+	t.Run("Keep-alive is announced", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetRequestVersion(1, 0)
+
+		require.NoError(t, Write(w, StatusOK, headers.NewHeaders(), []byte("hi")))
+		assert.True(t, w.KeepAlive())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nhi", conn.String())
+	})
+}
+
+func TestHeadResponse(t *testing.T) {
+	t.Run("Body is discarded", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetRequestMethod("HEAD")
+
+		require.NoError(t, Write(w, StatusOK, headers.NewHeaders(), []byte("hello")))
+		assert.True(t, w.Done())
+		assert.True(t, w.KeepAlive())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", conn.String())
+	})
+
+	t.Run("Chunked body is discarded", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetRequestMethod("HEAD")
+
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.WriteChunkedBody([]byte("hello"))
+		require.NoError(t, err)
+		_, err = w.WriteChunkedBodyDone()
+		require.NoError(t, err)
+		require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+		require.NoError(t, w.Finish())
+
+		assert.True(t, w.KeepAlive())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", conn.String())
+	})
+}
+
+func TestConditional(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	const (
+		etag    = `"v2"`
+		before  = "Tue, 30 Apr 2024 12:00:00 GMT"
+		at      = "Wed, 01 May 2024 12:00:00 GMT"
+		invalid = "yesterday"
+	)
+
+	t.Run("ETags", func(t *testing.T) {
+		assert.Equal(t, StrongETag([]byte("hello")), StrongETag([]byte("hello")))
+		assert.NotEqual(t, StrongETag([]byte("hello")), StrongETag([]byte("hellO")))
+		assert.Regexp(t, `^"[0-9a-f]{32}"$`, StrongETag(nil))
+
+		assert.Regexp(t, `^W/"[0-9a-f]+-[0-9a-f]+"$`, WeakETag(modTime, 100))
+		assert.NotEqual(t, WeakETag(modTime, 100), WeakETag(modTime, 101))
+		assert.NotEqual(t, WeakETag(modTime, 100), WeakETag(modTime.Add(time.Second), 100))
+	})
+
+	t.Run("Preconditions", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			method string
+			fields []string
+			etag   string
+			want   StatusCode
+		}{
+			{"no conditions", "GET", nil, etag, StatusOK},
+			{"If-None-Match hit", "GET", []string{"If-None-Match", `"v1", "v2"`}, etag, StatusNotModified},
+			{"If-None-Match weak hit", "HEAD", []string{"If-None-Match", `W/"v2"`}, etag, StatusNotModified},
+			{"If-None-Match miss", "GET", []string{"If-None-Match", `"v1"`}, etag, StatusOK},
+			{"If-None-Match star", "GET", []string{"If-None-Match", "*"}, "", StatusNotModified},
+			{"If-None-Match on PUT", "PUT", []string{"If-None-Match", "*"}, etag, StatusPreconditionFailed},
+			{"If-None-Match wins over If-Modified-Since", "GET", []string{"If-None-Match", `"v1"`, "If-Modified-Since", at}, etag, StatusOK},
+			{"If-Match hit", "PUT", []string{"If-Match", `"v1", "v2"`}, etag, StatusOK},
+			{"If-Match with comma in tag", "PUT", []string{"If-Match", `"a,b"`}, `"a,b"`, StatusOK},
+			{"If-Match miss", "PUT", []string{"If-Match", `"v1"`}, etag, StatusPreconditionFailed},
+			{"If-Match is strong", "PUT", []string{"If-Match", `W/"v2"`}, `W/"v2"`, StatusPreconditionFailed},
+			{"If-Match without an ETag", "PUT", []string{"If-Match", `"v2"`}, "", StatusPreconditionFailed},
+			{"If-Match star", "DELETE", []string{"If-Match", "*"}, "", StatusOK},
+			{"If-Match wins over If-Unmodified-Since", "PUT", []string{"If-Match", etag, "If-Unmodified-Since", before}, etag, StatusOK},
+			{"If-Unmodified-Since passed", "PUT", []string{"If-Unmodified-Since", at}, etag, StatusOK},
+			{"If-Unmodified-Since failed", "PUT", []string{"If-Unmodified-Since", before}, etag, StatusPreconditionFailed},
+			{"If-Unmodified-Since invalid", "PUT", []string{"If-Unmodified-Since", invalid}, etag, StatusOK},
+			{"If-Modified-Since not modified", "GET", []string{"If-Modified-Since", at}, etag, StatusNotModified},
+			{"If-Modified-Since modified", "GET", []string{"If-Modified-Since", before}, etag, StatusOK},
+			{"If-Modified-Since on POST", "POST", []string{"If-Modified-Since", at}, etag, StatusOK},
+			{"If-Modified-Since invalid", "GET", []string{"If-Modified-Since", invalid}, etag, StatusOK},
+			{"If-Match before If-None-Match", "GET", []string{"If-Match", `"v1"`, "If-None-Match", etag}, etag, StatusPreconditionFailed},
+		}
+
+		for _, tc := range tests {
+			h := headers.NewHeaders()
+			for i := 0; i < len(tc.fields); i += 2 {
+				h.Add(tc.fields[i], tc.fields[i+1])
+			}
+			assert.Equal(t, tc.want, CheckPreconditions(tc.method, h, tc.etag, modTime), tc.name)
+		}
+	})
+
+	t.Run("Write 304", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		h := headers.NewHeaders()
+		h.Set("If-None-Match", etag)
+
+		assert.True(t, WriteConditional(w, "GET", h, etag, modTime))
+		assert.True(t, w.Done())
+		assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nETag: \"v2\"\r\nLast-Modified: Wed, 01 May 2024 12:00:00 GMT\r\n\r\n", conn.String())
+	})
+
+	t.Run("Write 412", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		h := headers.NewHeaders()
+		h.Set("If-Match", `"v1"`)
+
+		assert.True(t, WriteConditional(w, "PUT", h, etag, modTime))
+		assert.Equal(t, StatusPreconditionFailed, w.StatusCode())
+	})
+
+	t.Run("Nothing written when preconditions pass", func(t *testing.T) {
+		w := NewWriter(&bytes.Buffer{})
+		assert.False(t, WriteConditional(w, "GET", headers.NewHeaders(), etag, modTime))
+		assert.False(t, w.Started())
+	})
+}
+
+// decode decompresses body sent with a Content-Encoding.
+func decode(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	var r io.Reader
+	var err error
+	switch encoding {
+	case EncodingGzip:
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case EncodingDeflate:
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	case EncodingBrotli:
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// readResponse parses a response written by a Writer.
+func readResponse(t *testing.T, conn *bytes.Buffer) (*http.Response, []byte) {
+	t.Helper()
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func TestCompression(t *testing.T) {
+	text := strings.Repeat("All work and no play makes Jack a dull boy. ", 100)
+
+	t.Run("Negotiate encoding", func(t *testing.T) {
+		tests := []struct{ accept, want string }{
+			{"", ""},
+			{"gzip", EncodingGzip},
+			{"gzip, deflate, br", EncodingBrotli},
+			{"deflate, gzip;q=1.0", EncodingGzip},
+			{"br;q=0.5, gzip;q=0.8", EncodingGzip},
+			{"br;q=0, gzip;q=0", ""},
+			{"*", EncodingBrotli},
+			{"*;q=0.1, br;q=0", EncodingGzip},
+			{"identity", ""},
+			{"X-GZIP", EncodingGzip},
+			{"compress, zstd", ""},
+			{"gzip;q=abc, deflate;q=0.2", EncodingDeflate},
+		}
+
+		for _, tc := range tests {
+			assert.Equal(t, tc.want, NegotiateEncoding(tc.accept), tc.accept)
+		}
+	})
+
+	t.Run("Fixed-length bodies", func(t *testing.T) {
+		for _, encoding := range []string{EncodingBrotli, EncodingGzip, EncodingDeflate} {
+			conn := &bytes.Buffer{}
+			w := NewWriter(conn)
+			w.SetCompression(encoding, 0)
+
+			h := GetDefaultHeaders()
+			h.Set("ETag", `"v1"`)
+			require.NoError(t, Write(w, StatusOK, h, []byte(text)))
+			assert.True(t, w.Done())
+
+			resp, body := readResponse(t, conn)
+			assert.Equal(t, encoding, resp.Header.Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+			assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+			assert.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+			assert.Less(t, len(body), len(text))
+			assert.Equal(t, text, decode(t, encoding, body))
+		}
+	})
+
+	t.Run("Chunked bodies", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetCompression(EncodingGzip, 0)
+
+		h := GetDefaultHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Vary", "Origin")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		for range 4 {
+			_, err := w.WriteChunkedBody([]byte(text[:len(text)/4]))
+			require.NoError(t, err)
+		}
+		_, err := w.WriteChunkedBodyDone()
+		require.NoError(t, err)
+		require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+
+		resp, body := readResponse(t, conn)
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Origin, Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Equal(t, text, decode(t, EncodingGzip, body))
+		assert.Equal(t, int64(len(body)), w.BodyBytes())
+	})
+
+	t.Run("Streamed Content-Length body is sent chunked", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetCompression(EncodingDeflate, 0)
+
+		h := GetDefaultHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(text)))
+		h.Set("Accept-Ranges", "bytes")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.Write([]byte(text))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+		assert.True(t, w.KeepAlive())
+
+		resp, body := readResponse(t, conn)
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+		assert.Empty(t, resp.Header.Get("Accept-Ranges"))
+		assert.Equal(t, text, decode(t, EncodingDeflate, body))
+	})
+
+	t.Run("HTTP/1.0 streamed body", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetRequestVersion(1, 0)
+		w.SetCompression(EncodingBrotli, 0)
+
+		h := GetDefaultHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		require.NoError(t, StartStream(w, StatusOK, h))
+		_, err := w.Write([]byte(text))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+
+		raw := conn.String()
+		head, body, _ := strings.Cut(raw, "\r\n\r\n")
+		assert.Contains(t, head, "Content-Encoding: br")
+		assert.NotContains(t, head, "Transfer-Encoding")
+		assert.Equal(t, text, decode(t, EncodingBrotli, []byte(body)))
+	})
+
+	t.Run("Skipped bodies", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			contentType string
+			statusCode  StatusCode
+			body        string
+			vary        bool
+		}{
+			{"tiny body", "text/plain", StatusOK, "tiny", true},
+			{"image", "image/png", StatusOK, text, false},
+			{"video", "video/mp4", StatusOK, text, false},
+			{"zip", "application/zip", StatusOK, text, false},
+			{"partial content", "text/plain", StatusPartialContent, text, false},
+		}
+
+		for _, tc := range tests {
+			conn := &bytes.Buffer{}
+			w := NewWriter(conn)
+			w.SetCompression(EncodingGzip, 0)
+
+			h := headers.NewHeaders()
+			h.Set("Content-Type", tc.contentType)
+			require.NoError(t, Write(w, tc.statusCode, h, []byte(tc.body)))
+
+			resp, body := readResponse(t, conn)
+			assert.Empty(t, resp.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, tc.body, string(body), tc.name)
+			assert.Equal(t, tc.vary, resp.Header.Get("Vary") == "Accept-Encoding", tc.name)
+		}
+	})
+
+	t.Run("Body already encoded", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetCompression(EncodingGzip, 0)
+
+		h := GetDefaultHeaders()
+		h.Set("Content-Encoding", "br")
+		require.NoError(t, Write(w, StatusOK, h, []byte(text)))
+
+		resp, body := readResponse(t, conn)
+		assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, text, string(body))
+	})
+
+	t.Run("Identity still varies", func(t *testing.T) {
+		conn := &bytes.Buffer{}
+		w := NewWriter(conn)
+		w.SetCompression(NegotiateEncoding(""), 0)
+
+		require.NoError(t, Write(w, StatusOK, GetDefaultHeaders(), []byte(text)))
+
+		resp, body := readResponse(t, conn)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Equal(t, text, string(body))
+	})
+}
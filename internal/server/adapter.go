@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+)
+
+// hopByHopHeaders only describe a single connection and are never copied
+// between the two stacks.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// FromHTTPHandler runs a net/http handler on this server. The handler gets an
+// *http.Request translated from the parsed request and an http.ResponseWriter,
+// which also implements http.Flusher, backed by the response.Writer.
+func FromHTTPHandler(h http.Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		httpReq, err := toHTTPRequest(req)
+		if err != nil {
+			log.Printf("Error: could not translate request for net/http handler: %v", err)
+			_ = response.Write(w, response.StatusBadRequest, response.GetDefaultHeaders(), []byte(response.StatusText(response.StatusBadRequest)))
+			return
+		}
+
+		rw := &httpResponseWriter{w: w, header: make(http.Header)}
+		h.ServeHTTP(rw, httpReq)
+		rw.finish()
+	}
+}
+
+func toHTTPRequest(req *request.Request) (*http.Request, error) {
+	target := req.RequestLine.RequestTarget
+	u := &url.URL{
+		Scheme:   req.Target.Scheme,
+		Host:     req.Target.Host,
+		Path:     req.Target.Path,
+		RawQuery: req.Target.RawQuery,
+	}
+	if req.Target.RawPath != u.EscapedPath() {
+		u.RawPath = req.Target.RawPath
+	}
+
+	header := make(http.Header)
+	for k, v := range req.Headers.All() {
+		header.Add(k, v)
+	}
+
+	// net/http keeps Host out of Header and on the request itself
+	host := header.Get("Host")
+	header.Del("Host")
+
+	httpReq := &http.Request{
+		Method:     req.RequestLine.Method,
+		URL:        u,
+		Proto:      "HTTP/" + req.RequestLine.HTTPVersion,
+		ProtoMajor: req.RequestLine.ProtoMajor,
+		ProtoMinor: req.RequestLine.ProtoMinor,
+		Header:     header,
+		Body:       req.BodyReader,
+		Host:       host,
+		RemoteAddr: req.RemoteAddr,
+		RequestURI: target,
+		TLS:        req.TLS,
+	}
+
+	if req.Headers.HasToken("Transfer-Encoding", "chunked") {
+		httpReq.TransferEncoding = []string{"chunked"}
+		httpReq.ContentLength = -1
+	} else if val, ok := req.Headers.Get("Content-Length"); ok {
+		// The parser only lets through lists of one repeated value
+		first, _, _ := strings.Cut(val, ",")
+		length, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content length %q", val)
+		}
+		httpReq.ContentLength = length
+	}
+
+	return httpReq.WithContext(req.Context()), nil
+}
+
+// adapterBufferSize is how much body an http.Handler can write before the
+// headers are sent, matching the buffering net/http does.
+const adapterBufferSize = 4 << 10
+
+// httpResponseWriter implements http.ResponseWriter on top of response.Writer.
+// Like net/http, the start of the body is buffered until the handler flushes,
+// writes more than adapterBufferSize or returns, so short responses get a
+// Content-Length and longer ones are chunked.
+type httpResponseWriter struct {
+	w           *response.Writer
+	header      http.Header
+	wroteHeader bool
+	statusCode  int
+	buf         []byte
+}
+
+func (rw *httpResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *httpResponseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		log.Printf("Error: superfluous WriteHeader call with status %d", statusCode)
+		return
+	}
+	// Informational responses cannot be sent ahead of the final one here
+	if statusCode >= 100 && statusCode < 200 {
+		return
+	}
+
+	rw.wroteHeader = true
+	rw.statusCode = statusCode
+}
+
+func (rw *httpResponseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.w.Started() && len(rw.buf)+len(p) <= adapterBufferSize {
+		rw.buf = append(rw.buf, p...)
+		return len(p), nil
+	}
+
+	if err := rw.flushBuffer(false, p); err != nil {
+		return 0, err
+	}
+	return rw.w.Write(p)
+}
+
+// Flush sends the headers and any buffered body to the client.
+func (rw *httpResponseWriter) Flush() {
+	if err := rw.flushBuffer(false, nil); err != nil {
+		log.Printf("Error: could not flush response: %v", err)
+	}
+}
+
+// flushBuffer writes the headers if they have not gone out yet, followed by the
+// buffered body. final means the buffer holds the whole body. pending is the
+// write that is about to follow it, which the Content-Type is sniffed from too.
+func (rw *httpResponseWriter) flushBuffer(final bool, pending []byte) error {
+	if rw.w.Started() {
+		return nil
+	}
+
+	sniff := rw.buf
+	if len(sniff) < sniffLen && len(pending) > 0 {
+		sniff = append(slices.Clip(sniff), pending[:min(len(pending), sniffLen-len(sniff))]...)
+	}
+	if err := rw.commit(rw.buf, sniff, final); err != nil {
+		return err
+	}
+
+	buf := rw.buf
+	rw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := rw.w.Write(buf)
+	return err
+}
+
+// commit writes the status line and headers, sniffing the Content-Type from
+// the start of the body in sniff if the handler set none. When final is set
+// the whole body is known (it is p) and gets a Content-Length, otherwise a
+// response without one is sent chunked.
+func (rw *httpResponseWriter) commit(p, sniff []byte, final bool) error {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if rw.header.Get("Content-Type") == "" && len(sniff) > 0 {
+		rw.header.Set("Content-Type", http.DetectContentType(sniff))
+	}
+	// 204 and 304 responses have no body to frame
+	bodyless := rw.statusCode == http.StatusNoContent || rw.statusCode == http.StatusNotModified
+	if !bodyless && rw.header.Get("Content-Length") == "" {
+		if final {
+			rw.header.Set("Content-Length", strconv.Itoa(len(p)))
+		} else {
+			rw.header.Set("Transfer-Encoding", "chunked")
+		}
+	}
+
+	h := headers.NewHeaders()
+	for _, k := range slices.Sorted(func(yield func(string) bool) {
+		for k := range rw.header {
+			if !yield(k) {
+				return
+			}
+		}
+	}) {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		for _, v := range rw.header[k] {
+			h.Add(k, v)
+		}
+	}
+
+	return response.StartStream(rw.w, response.StatusCode(rw.statusCode), h)
+}
+
+// finish completes the response once the handler has returned, sending any
+// trailers the handler declared.
+func (rw *httpResponseWriter) finish() {
+	if !rw.w.Started() {
+		if err := rw.flushBuffer(true, nil); err != nil {
+			log.Printf("Error: could not write response: %v", err)
+		}
+		return
+	}
+
+	if !strings.EqualFold(rw.header.Get("Transfer-Encoding"), "chunked") {
+		return
+	}
+
+	trailers := headers.NewHeaders()
+	for k, vs := range rw.header {
+		name, prefixed := strings.CutPrefix(k, http.TrailerPrefix)
+		if !prefixed && !isDeclaredTrailer(rw.header, k) {
+			continue
+		}
+		for _, v := range vs {
+			trailers.Add(name, v)
+		}
+	}
+
+	if _, err := rw.w.WriteChunkedBodyDone(); err != nil {
+		log.Printf("Error: could not finish chunked response: %v", err)
+		return
+	}
+	if err := rw.w.WriteTrailers(trailers); err != nil {
+		log.Printf("Error: could not write trailers: %v", err)
+	}
+}
+
+func isDeclaredTrailer(header http.Header, key string) bool {
+	for _, declared := range header.Values("Trailer") {
+		for name := range strings.SplitSeq(declared, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(name)) == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ToHTTPHandler mounts a Handler inside net/http, e.g. on an http.ServeMux.
+// The handler writes its response to a pipe that is parsed back and copied to
+// the http.ResponseWriter, flushing after every read so streams keep flowing.
+// A panic in the handler is recovered and answered with a 500, or aborts the
+// response with http.ErrAbortHandler if it had already started.
+func ToHTTPHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req := fromHTTPRequest(r)
+
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		// panicked is only read once done is closed
+		var panicked bool
+		go func() {
+			defer close(done)
+			// The handler runs on its own goroutine, out of net/http's reach, so
+			// a panic would otherwise take down the whole process
+			defer func() {
+				if v := recover(); v != nil {
+					log.Printf("Error: panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, v, debug.Stack())
+					panicked = true
+					_ = pw.CloseWithError(fmt.Errorf("handler panicked: %v", v))
+				}
+			}()
+
+			w := response.NewWriter(pw)
+			w.SetRequestMethod(req.RequestLine.Method)
+			h(w, req)
+			finishResponse(w)
+			_ = pw.Close()
+		}()
+		// Closing the read side unblocks a handler still writing to the pipe
+		defer func() {
+			_ = pr.Close()
+			<-done
+			if err := req.RemoveMultipartFiles(); err != nil {
+				log.Printf("Error: could not remove multipart files: %v", err)
+			}
+		}()
+
+		resp, err := http.ReadResponse(bufio.NewReader(pr), r)
+		if err != nil {
+			log.Printf("Error: could not read handler response: %v", err)
+			http.Error(rw, response.StatusText(response.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		for k, vs := range resp.Header {
+			rw.Header()[k] = vs
+		}
+		for _, k := range hopByHopHeaders {
+			rw.Header().Del(k)
+		}
+		for k := range resp.Trailer {
+			rw.Header().Add("Trailer", k)
+		}
+		rw.WriteHeader(resp.StatusCode)
+
+		if err := copyAndFlush(rw, resp.Body); err != nil {
+			log.Printf("Error: could not copy handler response: %v", err)
+			_ = pr.Close()
+			<-done
+			if panicked {
+				// Otherwise net/http would end the body as if it were complete
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+
+		// Trailers are only known once the body has been read in full
+		for k, vs := range resp.Trailer {
+			rw.Header()[k] = vs
+		}
+	})
+}
+
+func fromHTTPRequest(r *http.Request) *request.Request {
+	req := request.NewRequest(r.Method, r.URL.RequestURI(), r.Body)
+	req.RequestLine.HTTPVersion = fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+	req.RequestLine.ProtoMajor = r.ProtoMajor
+	req.RequestLine.ProtoMinor = r.ProtoMinor
+	req.RemoteAddr = r.RemoteAddr
+	req.TLS = r.TLS
+
+	req.Headers.Add("Host", r.Host)
+	for _, k := range slices.Sorted(func(yield func(string) bool) {
+		for k := range r.Header {
+			if !yield(k) {
+				return
+			}
+		}
+	}) {
+		for _, v := range r.Header[k] {
+			req.Headers.Add(k, v)
+		}
+	}
+	return req.WithContext(r.Context())
+}
+
+func copyAndFlush(rw http.ResponseWriter, body io.Reader) error {
+	flusher, _ := rw.(http.Flusher)
+	buf := make([]byte, 32<<10)
+
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := rw.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
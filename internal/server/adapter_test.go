@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromHTTPHandler(t *testing.T) {
+	t.Run("Request is translated and body gets a Content-Length", func(t *testing.T) {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+
+			w.Header().Set("X-Echo", r.Header.Get("X-Test"))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = fmt.Fprintf(w, "%s %s %s %s %s", r.Method, r.URL.Path, r.URL.Query().Get("q"), r.Host, body)
+		})
+		_, addr := startTestServer(t, func(req *request.Request) Handler { return FromHTTPHandler(h) })
+
+		req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/things?q=1", strings.NewReader("data"))
+		require.NoError(t, err)
+		req.Header.Set("X-Test", "hello")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "hello", resp.Header.Get("X-Echo"))
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "POST /things 1 "+addr+" data", string(body))
+		assert.Equal(t, int64(len(body)), resp.ContentLength)
+	})
+
+	t.Run("Flushed response is chunked with trailers", func(t *testing.T) {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Sum")
+			_, _ = io.WriteString(w, "part one,")
+			w.(http.Flusher).Flush()
+			_, _ = io.WriteString(w, "part two")
+			w.Header().Set("X-Sum", "abc")
+			w.Header().Set(http.TrailerPrefix+"X-Late", "def")
+		})
+		_, addr := startTestServer(t, func(req *request.Request) Handler { return FromHTTPHandler(h) })
+
+		resp, err := http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+		assert.Equal(t, "part one,part two", string(body))
+		assert.Equal(t, "abc", resp.Trailer.Get("X-Sum"))
+		assert.Equal(t, "def", resp.Trailer.Get("X-Late"))
+	})
+
+	t.Run("Content-Type sniffed from a large first write", func(t *testing.T) {
+		page := "<html><body>" + strings.Repeat("x", adapterBufferSize) + "</body></html>"
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, page)
+		})
+		_, addr := startTestServer(t, func(req *request.Request) Handler { return FromHTTPHandler(h) })
+
+		resp, err := http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, page, string(body))
+	})
+
+	t.Run("Handler that writes nothing sends an empty 200", func(t *testing.T) {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		_, addr := startTestServer(t, func(req *request.Request) Handler { return FromHTTPHandler(h) })
+
+		resp, err := http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, int64(0), resp.ContentLength)
+	})
+}
+
+func TestToHTTPHandler(t *testing.T) {
+	t.Run("Fixed length response", func(t *testing.T) {
+		h := ToHTTPHandler(func(w *response.Writer, req *request.Request) {
+			body, err := io.ReadAll(req.BodyReader)
+			assert.NoError(t, err)
+
+			host, _ := req.Headers.Get("Host")
+			test, _ := req.Headers.Get("X-Test")
+			h := response.GetDefaultHeaders()
+			h.Set("X-Echo", test)
+			_ = response.Write(w, response.StatusAccepted, h, fmt.Appendf(nil, "%s %s %s %s", req.RequestLine.Method, req.RequestLine.RequestTarget, host, body))
+		})
+
+		req := httptest.NewRequest(http.MethodPut, "http://example.com/a?b=c", strings.NewReader("data"))
+		req.Header.Set("X-Test", "hello")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.Equal(t, "hello", rec.Header().Get("X-Echo"))
+		assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "PUT /a?b=c example.com data", rec.Body.String())
+	})
+
+	t.Run("Chunked response streams through with trailers", func(t *testing.T) {
+		h := ToHTTPHandler(func(w *response.Writer, req *request.Request) {
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			h.SetTrailers("X-Sum")
+			_ = response.StartStream(w, response.StatusOK, h)
+
+			_, _ = w.WriteChunkedBody([]byte("hello "))
+			_, _ = w.WriteChunkedBody([]byte("world"))
+			_, _ = w.WriteChunkedBodyDone()
+
+			trailers := headers.NewHeaders()
+			trailers.Set("X-Sum", "abc")
+			_ = w.WriteTrailers(trailers)
+		})
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, "hello world", string(body))
+		assert.Equal(t, "abc", resp.Trailer.Get("X-Sum"))
+	})
+
+	t.Run("Panic before response started gets 500", func(t *testing.T) {
+		h := ToHTTPHandler(func(w *response.Writer, req *request.Request) {
+			panic("boom")
+		})
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	})
+
+	t.Run("Panic mid-stream aborts response", func(t *testing.T) {
+		h := ToHTTPHandler(func(w *response.Writer, req *request.Request) {
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			_ = response.StartStream(w, response.StatusOK, h)
+			_, _ = w.WriteChunkedBody([]byte("partial"))
+			panic("boom")
+		})
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, err = io.ReadAll(resp.Body)
+		assert.Error(t, err)
+	})
+
+	t.Run("Mounted on a ServeMux", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.Handle("/ok", ToHTTPHandler(okHandler))
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		conn, err := (&net.Dialer{}).Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		resp := sendRequest(t, conn, bufio.NewReader(conn), "/ok")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
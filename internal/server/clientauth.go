@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+)
+
+// AnyClient is the identity in an AuthorizeClients policy that matches every
+// client with a verified certificate.
+const AnyClient = "*"
+
+// AuthorizeClients only lets a request through if its verified client
+// certificate carries an identity allowed to use the route. allowed maps
+// identities, as returned by Request.ClientIdentities, to Mux patterns such as
+// "GET /orders/{id}". Requests without a verified certificate or whose
+// identities match none of their patterns get a 403.
+//
+// It panics if a pattern is malformed.
+func AuthorizeClients(allowed map[string][]string) Middleware {
+	policy := make(map[string][]route, len(allowed))
+	for identity, patterns := range allowed {
+		for _, pattern := range patterns {
+			r, err := parsePattern(pattern)
+			if err != nil {
+				panic(fmt.Sprintf("server: invalid pattern %q for %q: %v", pattern, identity, err))
+			}
+			policy[identity] = append(policy[identity], r)
+		}
+	}
+
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if clientAllowed(policy, req) {
+				next(w, req)
+				return
+			}
+
+			log.Printf("Error: client %v not allowed to %s %s", req.ClientIdentities(), req.RequestLine.Method, req.RequestLine.RequestTarget)
+			statusCode := response.StatusForbidden
+			_ = response.Write(w, statusCode, response.GetDefaultHeaders(), []byte(response.StatusText(statusCode)))
+		}
+	}
+}
+
+func clientAllowed(policy map[string][]route, req *request.Request) bool {
+	ids := req.ClientIdentities()
+	if len(ids) == 0 {
+		return false
+	}
+	parts, ok := pathSegments(req)
+	if !ok {
+		return false
+	}
+
+	for _, id := range append(ids, AnyClient) {
+		for _, r := range policy[id] {
+			if _, ok := r.match(parts); ok && r.allows(req.RequestLine.Method) {
+				return true
+			}
+		}
+	}
+	return false
+}
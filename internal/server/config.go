@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+)
+
+// Config controls where a Server listens and how it serves connections. The
+// zero value listens on TCP port 42069 on every interface.
+type Config struct {
+	// Network is passed to net.Listen: "tcp", "tcp4", "tcp6" or "unix".
+	// Defaults to "tcp".
+	Network string
+	// Addr is host:port for TCP networks or a socket path for "unix". Use port 0
+	// to let the OS pick a free port and read it back with Server.Addr.
+	Addr string
+	// TLSConfig, if set, makes the server speak HTTPS on every listener. See
+	// ServeTLS for serving certificates from files.
+	TLSConfig *tls.Config
+	// ClientCertMode asks TLS clients for certificates, verified against
+	// ClientCAs, so handlers can authenticate them. See
+	// Request.ClientCertificate.
+	ClientCertMode ClientCertMode
+	// ClientCAs holds the CAs client certificates must chain to. Defaults to
+	// TLSConfig.ClientCAs.
+	ClientCAs *x509.CertPool
+
+	// ReadHeaderTimeout bounds reading the request line and headers, measured
+	// from the first byte of the request. Falls back to ReadTimeout when zero.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading the whole request, body included.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing the response, measured from the end of the
+	// request headers.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds how long a keep-alive connection may wait for its next
+	// request. Falls back to ReadTimeout when zero.
+	IdleTimeout time.Duration
+	// HandlerTimeout bounds how long a handler may run: its request context is
+	// cancelled once it passes. Zero means no limit.
+	HandlerTimeout time.Duration
+
+	// Limits bounds the size of incoming requests. Zero fields use the defaults
+	// from the request package.
+	Limits request.Limits
+
+	// OnPanic, if set, is called with the request, the recovered value and the
+	// stack trace whenever the router or a handler panics, e.g. to report it to
+	// an error tracker. The panic is logged and answered either way.
+	OnPanic func(req *request.Request, value any, stack []byte)
+}
+
+// ClientCertMode is how a TLS server asks clients for certificates.
+type ClientCertMode int
+
+const (
+	// NoClientCert leaves client authentication to TLSConfig.ClientAuth.
+	NoClientCert ClientCertMode = iota
+	// RequestClientCert asks for a certificate and verifies it if one is sent,
+	// but lets clients without one connect.
+	RequestClientCert
+	// RequireClientCert fails the handshake unless the client sends a
+	// certificate that verifies.
+	RequireClientCert
+)
+
+const (
+	defaultNetwork = "tcp"
+	defaultAddr    = ":42069"
+)
+
+func (c Config) listen() (net.Listener, error) {
+	network := c.Network
+	if network == "" {
+		network = defaultNetwork
+	}
+
+	addr := c.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	return net.Listen(network, addr)
+}
+
+func (c Config) validate() error {
+	if c.ClientCertMode == NoClientCert {
+		return nil
+	}
+	if c.TLSConfig == nil {
+		return errors.New("server: client certificates need a TLSConfig")
+	}
+	if c.ClientCAs == nil && c.TLSConfig.ClientCAs == nil {
+		return errors.New("server: client certificates need ClientCAs to verify against")
+	}
+	return nil
+}
+
+// tlsConfig returns TLSConfig with the client certificate options applied, or
+// nil for a plaintext server.
+func (c Config) tlsConfig() *tls.Config {
+	if c.TLSConfig == nil || c.ClientCertMode == NoClientCert {
+		return c.TLSConfig
+	}
+
+	cfg := c.TLSConfig.Clone()
+	if c.ClientCAs != nil {
+		cfg.ClientCAs = c.ClientCAs
+	}
+	switch c.ClientCertMode {
+	case RequestClientCert:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case RequireClientCert:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+func (c Config) readHeaderTimeout() time.Duration {
+	if c.ReadHeaderTimeout > 0 {
+		return c.ReadHeaderTimeout
+	}
+	return c.ReadTimeout
+}
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleTimeout > 0 {
+		return c.IdleTimeout
+	}
+	return c.ReadTimeout
+}
+
+// deadline returns the time timeout after start, or the zero time (no deadline)
+// if timeout is not set.
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
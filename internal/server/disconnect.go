@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+)
+
+// disconnectWatcher cancels a request's context if the client closes the
+// connection while its handler is running. It does so by waiting for the next
+// request in the background, so bytes of a pipelined request that arrive in
+// the meantime stay in the Reader for the next iteration to parse.
+type disconnectWatcher struct {
+	conn   net.Conn
+	reader *request.Reader
+	cancel context.CancelCauseFunc
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	done    chan struct{}
+}
+
+func newDisconnectWatcher(conn net.Conn, reader *request.Reader, cancel context.CancelCauseFunc) *disconnectWatcher {
+	return &disconnectWatcher{
+		conn:   conn,
+		reader: reader,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+func (d *disconnectWatcher) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.started || d.stopped {
+		return
+	}
+	d.started = true
+
+	go func() {
+		defer close(d.done)
+
+		err := d.reader.WaitForRequest()
+		// A timeout is either stop interrupting the wait or ReadTimeout passing,
+		// neither of which says anything about the client
+		if err != nil && !isTimeout(err) {
+			d.cancel(ErrClientDisconnected)
+		}
+	}()
+}
+
+// stop ends the watch once the handler has returned. The read deadline is left
+// in the past, so the caller must set a new one before reading again.
+func (d *disconnectWatcher) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	started := d.started
+	d.mu.Unlock()
+
+	if !started {
+		return
+	}
+	_ = d.conn.SetReadDeadline(time.Now())
+	<-d.done
+}
+
+// watchedBody starts the disconnect watcher once the handler has read the body
+// to the end.
+type watchedBody struct {
+	io.ReadCloser
+	onEOF func()
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.onEOF()
+	}
+	return n, err
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+)
+
+// sniffLen is how much of a file is read to detect its Content-Type when its
+// extension does not give one away.
+const sniffLen = 512
+
+// FileServer serves the files in Root. Request paths are looked up relative to
+// Root after StripPrefix is removed, so it is usually mounted on a wildcard
+// pattern, e.g.
+//
+//	mux.Handle("GET /static/{path...}", (&server.FileServer{Root: root, StripPrefix: "/static"}).Serve)
+//
+// A directory is served by its index.html if it has one, otherwise by a
+// listing of its entries when ListDirectories is set, and a 403 when not.
+// Paths containing a ".." segment get a 403, and paths that do not exist a
+// 404.
+type FileServer struct {
+	Root fs.FS
+	// StripPrefix is removed from the request path before it is looked up.
+	// Requests whose path does not start with it get a 404.
+	StripPrefix string
+	// ListDirectories renders an HTML listing of directories without an
+	// index.html.
+	ListDirectories bool
+}
+
+// Dir returns the directory dir as an fs.FS for a FileServer. Unlike
+// os.DirFS, symbolic links cannot be used to reach files outside of it.
+func Dir(dir string) (fs.FS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return root.FS(), nil
+}
+
+// Serve is the FileServer's Handler.
+func (f *FileServer) Serve(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		methodNotAllowedHandler([]string{"GET", "HEAD"})(w, req)
+		return
+	}
+
+	urlPath, ok := strings.CutPrefix(req.Target.Path, f.StripPrefix)
+	if !ok || (urlPath != "" && !strings.HasPrefix(urlPath, "/")) {
+		writeStatus(w, response.StatusNotFound)
+		return
+	}
+	name, ok := fileName(urlPath)
+	if !ok {
+		log.Printf("Error: refusing to serve path %q", req.Target.Path)
+		writeStatus(w, response.StatusForbidden)
+		return
+	}
+
+	file, info, err := openFile(f.Root, name)
+	if err != nil {
+		writeFileError(w, name, err)
+		return
+	}
+	defer func() { _ = file.Close() }()
+
+	if !info.IsDir() {
+		// Only directories are addressed with a trailing slash
+		if strings.HasSuffix(urlPath, "/") {
+			writeStatus(w, response.StatusNotFound)
+			return
+		}
+		serveFile(w, req, file, info)
+		return
+	}
+
+	// Relative links in index.html and listings need the trailing slash. The
+	// redirect is relative too, as an absolute one for "//host" would send
+	// the client off to another site.
+	if !strings.HasSuffix(urlPath, "/") {
+		location := path.Base(req.Target.RawPath) + "/"
+		// A name with a colon would otherwise be read as a URL scheme
+		if strings.Contains(location, ":") {
+			location = "./" + location
+		}
+		redirect(w, req, location)
+		return
+	}
+
+	index, indexInfo, err := openFile(f.Root, path.Join(name, "index.html"))
+	if err == nil {
+		defer func() { _ = index.Close() }()
+		if !indexInfo.IsDir() {
+			serveFile(w, req, index, indexInfo)
+			return
+		}
+	}
+
+	if !f.ListDirectories {
+		writeStatus(w, response.StatusForbidden)
+		return
+	}
+	f.serveListing(w, req, name)
+}
+
+// ServeFile serves the file name from fsys, answering with a 404 if it does
+// not exist and a 403 if it is a directory or cannot be read.
+func ServeFile(w *response.Writer, req *request.Request, fsys fs.FS, name string) {
+	file, info, err := openFile(fsys, name)
+	if err != nil {
+		writeFileError(w, name, err)
+		return
+	}
+	defer func() { _ = file.Close() }()
+
+	if info.IsDir() {
+		writeStatus(w, response.StatusForbidden)
+		return
+	}
+	serveFile(w, req, file, info)
+}
+
+// fileName turns a decoded URL path into a name for fs.FS. It reports false for
+// paths that try to leave the root.
+func fileName(urlPath string) (string, bool) {
+	for segment := range strings.SplitSeq(urlPath, "/") {
+		if segment == ".." || strings.ContainsRune(segment, 0) {
+			return "", false
+		}
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+func openFile(fsys fs.FS, name string) (fs.File, fs.FileInfo, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("%s is not a regular file: %w", name, fs.ErrPermission)
+	}
+	return file, info, nil
+}
+
+func writeFileError(w *response.Writer, name string, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		writeStatus(w, response.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, fs.ErrInvalid):
+		log.Printf("Error: cannot serve %s: %v", name, err)
+		writeStatus(w, response.StatusForbidden)
+	default:
+		log.Printf("Error: could not open %s: %v", name, err)
+		writeStatus(w, response.StatusInternalServerError)
+	}
+}
+
+// serveFile streams a regular file with its Content-Type, Content-Length,
+// Last-Modified and a weak ETag, unless the handler set one already. Files
+// without a modification time, e.g. from an embed.FS, get neither, as the size
+// alone would give changed content the same ETag. Files that can seek are
+// served with ServeContent, so clients can ask for ranges of them.
+func serveFile(w *response.Writer, req *request.Request, file fs.File, info fs.FileInfo) {
+	etag, ok := w.Header().Get("ETag")
+	if !ok && !info.ModTime().IsZero() {
+		etag = response.WeakETag(info.ModTime(), info.Size())
+		w.Header().Set("ETag", etag)
+	}
+
+	if content, ok := file.(io.ReadSeeker); ok {
+		ServeContent(w, req, info.Name(), info.ModTime(), content)
+		return
+	}
+
+	if response.WriteConditional(w, req.RequestLine.Method, req.Headers, etag, info.ModTime()) {
+		return
+	}
+
+	contentType, body, err := detectContentType(info.Name(), file)
+	if err != nil {
+		log.Printf("Error: could not read %s: %v", info.Name(), err)
+		writeStatus(w, response.StatusInternalServerError)
+		return
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	if modTime := info.ModTime(); !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if err := response.StartStream(w, response.StatusOK, h); err != nil {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Error: could not send %s: %v", info.Name(), err)
+	}
+}
+
+// detectContentType works out the Content-Type of a file from its extension,
+// falling back to sniffing its first bytes. It returns a reader for the whole
+// file, as sniffing may have consumed some of it.
+func detectContentType(name string, file io.Reader) (string, io.Reader, error) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, file, nil
+	}
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", nil, err
+	}
+	buf = buf[:n]
+
+	if seeker, ok := file.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err == nil {
+			return http.DetectContentType(buf), file, nil
+		}
+	}
+	return http.DetectContentType(buf), io.MultiReader(bytes.NewReader(buf), file), nil
+}
+
+func (f *FileServer) serveListing(w *response.Writer, req *request.Request, name string) {
+	entries, err := fs.ReadDir(f.Root, name)
+	if err != nil {
+		writeFileError(w, name, err)
+		return
+	}
+
+	title := html.EscapeString(req.Target.Path)
+	var b strings.Builder
+	fmt.Fprintf(&b, "<html>\n  <head>\n    <title>Index of %s</title>\n  </head>\n  <body>\n    <h1>Index of %s</h1>\n    <ul>\n", title, title)
+	if name != "." {
+		b.WriteString("      <li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		href := (&url.URL{Path: entryName}).EscapedPath()
+		// A name with a colon would otherwise be read as a URL scheme
+		if strings.Contains(entry.Name(), ":") {
+			href = "./" + href
+		}
+		fmt.Fprintf(&b, "      <li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+	b.WriteString("    </ul>\n  </body>\n</html>\n")
+
+	h := response.GetDefaultHeaders()
+	h.Override("Content-Type", "text/html; charset=utf-8")
+	_ = response.Write(w, response.StatusOK, h, []byte(b.String()))
+}
+
+// redirect answers with a 301 to location, keeping the query.
+func redirect(w *response.Writer, req *request.Request, location string) {
+	if req.Target.RawQuery != "" {
+		location += "?" + req.Target.RawQuery
+	}
+	h := response.GetDefaultHeaders()
+	h.Set("Location", location)
+	_ = response.Write(w, response.StatusMovedPermanently, h, []byte(response.StatusText(response.StatusMovedPermanently)))
+}
+
+func writeStatus(w *response.Writer, statusCode response.StatusCode) {
+	_ = response.Write(w, statusCode, response.GetDefaultHeaders(), []byte(response.StatusText(statusCode)))
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServer(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	root := fstest.MapFS{
+		"hello.txt":            {Data: []byte("hello world"), ModTime: modTime},
+		"page.html":            {Data: []byte("<p>page</p>")},
+		"noext":                {Data: []byte("<!DOCTYPE html><html></html>")},
+		"docs/index.html":      {Data: []byte("docs index")},
+		"assets/app.css":       {Data: []byte("body {}")},
+		"assets/a b&c.txt":     {Data: []byte("spaced")},
+		"assets/img/logo.png":  {Data: []byte("\x89PNG\r\n\x1a\n")},
+		"private/secret.txt":   {Data: []byte("secret"), Mode: 0o600},
+		"private/nested/x.txt": {Data: []byte("x")},
+	}
+
+	m := NewMux()
+	m.Handle("GET /static/{path...}", (&FileServer{Root: root, StripPrefix: "/static"}).Serve)
+	m.Handle("GET /browse/{path...}", (&FileServer{Root: root, StripPrefix: "/browse", ListDirectories: true}).Serve)
+
+	t.Run("Files", func(t *testing.T) {
+		resp, body := routeRequest(t, m, "GET", "/static/hello.txt")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "hello world", body)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "11", resp.Header.Get("Content-Length"))
+		assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", resp.Header.Get("Last-Modified"))
+
+		resp, _ = routeRequest(t, m, "GET", "/static/page.html")
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+		// Without an extension the content is sniffed
+		resp, body = routeRequest(t, m, "GET", "/static/noext")
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "<!DOCTYPE html><html></html>", body)
+
+		resp, body = routeRequest(t, m, "GET", "/static/assets/a%20b&c.txt")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "spaced", body)
+	})
+
+	t.Run("HEAD", func(t *testing.T) {
+		var buf bytes.Buffer
+		req := request.NewRequest("HEAD", "/static/hello.txt", nil)
+		w := response.NewWriter(&buf)
+		w.SetRequestMethod("HEAD")
+		m.Route(req)(w, req)
+
+		assert.True(t, w.Done())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nETag: "+response.WeakETag(modTime, 11)+"\r\nAccept-Ranges: bytes\r\nLast-Modified: Wed, 01 May 2024 12:00:00 GMT\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 11\r\n\r\n", buf.String())
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		for _, target := range []string{"/static/missing.txt", "/static/hello.txt/", "/static/docs/missing/"} {
+			resp, _ := routeRequest(t, m, "GET", target)
+			assert.Equal(t, 404, resp.StatusCode, target)
+		}
+	})
+
+	t.Run("Path traversal", func(t *testing.T) {
+		for _, target := range []string{"/static/../hello.txt", "/static/assets/..%2f..%2fhello.txt", "/static/%2e%2e/hello.txt", "/static/a%00b"} {
+			resp, _ := routeRequest(t, m, "GET", target)
+			assert.Equal(t, 403, resp.StatusCode, target)
+		}
+	})
+
+	t.Run("Directories", func(t *testing.T) {
+		resp, body := routeRequest(t, m, "GET", "/static/docs/")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "docs index", body)
+
+		resp, _ = routeRequest(t, m, "GET", "/static/docs?x=1")
+		assert.Equal(t, 301, resp.StatusCode)
+		assert.Equal(t, "docs/?x=1", resp.Header.Get("Location"))
+
+		// A leading "//" must not turn the Location into another host
+		bare := NewMux()
+		bare.Handle("GET /{path...}", (&FileServer{Root: fstest.MapFS{"evil.com/index.html": {Data: []byte("x")}}}).Serve)
+		resp, _ = routeRequest(t, bare, "GET", "//evil.com")
+		assert.Equal(t, 301, resp.StatusCode)
+		assert.Equal(t, "evil.com/", resp.Header.Get("Location"))
+
+		// Listings are off unless asked for
+		resp, _ = routeRequest(t, m, "GET", "/static/assets/")
+		assert.Equal(t, 403, resp.StatusCode)
+	})
+
+	t.Run("Directory listing", func(t *testing.T) {
+		resp, body := routeRequest(t, m, "GET", "/browse/assets/")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Contains(t, body, "<title>Index of /browse/assets/</title>")
+		assert.Contains(t, body, `<a href="../">../</a>`)
+		assert.Contains(t, body, `<a href="a%20b&amp;c.txt">a b&amp;c.txt</a>`)
+		assert.Contains(t, body, `<a href="app.css">app.css</a>`)
+		assert.Contains(t, body, `<a href="img/">img/</a>`)
+
+		_, body = routeRequest(t, m, "GET", "/browse/")
+		assert.NotContains(t, body, `href="../"`)
+	})
+
+	t.Run("Method not allowed", func(t *testing.T) {
+		resp, _ := routeRequest(t, m, "POST", "/static/hello.txt")
+		assert.Equal(t, 405, resp.StatusCode)
+		assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+	})
+
+	t.Run("Symlinks cannot leave Dir", func(t *testing.T) {
+		dir := t.TempDir()
+		outside := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "public.txt"), []byte("public"), 0o644))
+		require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "link.txt")))
+
+		fsys, err := Dir(dir)
+		require.NoError(t, err)
+		m := NewMux()
+		m.Handle("GET /{path...}", (&FileServer{Root: fsys}).Serve)
+
+		resp, body := routeRequest(t, m, "GET", "/public.txt")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "public", body)
+
+		resp, body = routeRequest(t, m, "GET", "/link.txt")
+		assert.NotEqual(t, 200, resp.StatusCode)
+		assert.NotContains(t, body, "secret")
+	})
+
+	t.Run("ServeFile", func(t *testing.T) {
+		m := NewMux()
+		m.Handle("GET /video", func(w *response.Writer, req *request.Request) {
+			ServeFile(w, req, root, "hello.txt")
+		})
+		m.Handle("GET /missing", func(w *response.Writer, req *request.Request) {
+			ServeFile(w, req, root, "missing.mp4")
+		})
+
+		resp, body := routeRequest(t, m, "GET", "/video")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "hello world", body)
+
+		resp, _ = routeRequest(t, m, "GET", "/missing")
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestFileServerConditional(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	root := fstest.MapFS{"app.js": {Data: []byte("console.log(1)"), ModTime: modTime}}
+	etag := response.WeakETag(modTime, 14)
+
+	m := NewMux()
+	m.Handle("/{path...}", (&FileServer{Root: root}).Serve)
+	m.Handle("GET /strong", func(w *response.Writer, req *request.Request) {
+		w.Header().Set("ETag", response.StrongETag([]byte("0123456789")))
+		ServeContent(w, req, "strong.txt", time.Time{}, strings.NewReader("0123456789"))
+	})
+
+	// get sends a request with the given header fields, as name, value pairs.
+	get := func(target string, fields ...string) (*http.Response, string) {
+		var buf bytes.Buffer
+		req := request.NewRequest("GET", target, nil)
+		for i := 0; i < len(fields); i += 2 {
+			req.Headers.Add(fields[i], fields[i+1])
+		}
+		m.Route(req)(response.NewWriter(&buf), req)
+
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("Validators", func(t *testing.T) {
+		resp, _ := get("/app.js")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", resp.Header.Get("Last-Modified"))
+	})
+
+	t.Run("Not modified", func(t *testing.T) {
+		resp, body := get("/app.js", "If-None-Match", etag)
+		assert.Equal(t, 304, resp.StatusCode)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Empty(t, body)
+
+		resp, _ = get("/app.js", "If-Modified-Since", "Wed, 01 May 2024 12:00:00 GMT")
+		assert.Equal(t, 304, resp.StatusCode)
+
+		resp, body = get("/app.js", "If-None-Match", `W/"stale"`)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "console.log(1)", body)
+	})
+
+	t.Run("Precondition failed", func(t *testing.T) {
+		resp, _ := get("/app.js", "If-Match", `"other"`)
+		assert.Equal(t, 412, resp.StatusCode)
+
+		resp, _ = get("/app.js", "If-Unmodified-Since", "Tue, 30 Apr 2024 12:00:00 GMT")
+		assert.Equal(t, 412, resp.StatusCode)
+	})
+
+	t.Run("No ETag without a modification time", func(t *testing.T) {
+		m := NewMux()
+		m.Handle("/{path...}", (&FileServer{Root: fstest.MapFS{"a.txt": {Data: []byte("aaaa")}}}).Serve)
+		changed := NewMux()
+		changed.Handle("/{path...}", (&FileServer{Root: fstest.MapFS{"a.txt": {Data: []byte("bbbb")}}}).Serve)
+
+		resp, _ := routeRequest(t, m, "GET", "/a.txt")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("ETag"))
+
+		// A tag for the old content must not match the new
+		var buf bytes.Buffer
+		req := request.NewRequest("GET", "/a.txt", nil)
+		req.Headers.Add("If-None-Match", response.WeakETag(time.Time{}, 4))
+		changed.Route(req)(response.NewWriter(&buf), req)
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("If-Range needs a strong ETag", func(t *testing.T) {
+		resp, _ := get("/app.js", "Range", "bytes=0-6", "If-Range", etag)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		resp, body := get("/strong", "Range", "bytes=0-3", "If-Range", response.StrongETag([]byte("0123456789")))
+		assert.Equal(t, 206, resp.StatusCode)
+		assert.Equal(t, "0123", body)
+	})
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+)
+
+// Middleware wraps a Handler with behaviour that applies across handlers, such
+// as logging or authentication.
+type Middleware func(Handler) Handler
+
+// RequestIDHeader carries the request ID set by the RequestID middleware.
+const RequestIDHeader = "X-Request-ID"
+
+// Chain wraps h in middleware. The first middleware is the outermost, so it
+// sees the request first and the response last.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Use adds middleware around every handler the server's router returns. It
+// applies to requests routed after the call.
+func (s *Server) Use(middleware ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.middleware = append(s.middleware, middleware...)
+}
+
+func (s *Server) route(req *request.Request) Handler {
+	s.mu.Lock()
+	middleware := s.middleware
+	s.mu.Unlock()
+
+	return Chain(s.router(req), middleware...)
+}
+
+// Use adds middleware around every handler the mux routes to, including its
+// 404 and 405 responses. It applies to requests routed after the call.
+func (m *Mux) Use(middleware ...Middleware) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.middleware = append(m.middleware, middleware...)
+}
+
+// Logger logs one line per request with the status code, body size and how
+// long the handler took. A nil logger uses the standard logger.
+func Logger(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+
+			logger.Printf("%s %s %s -> %d (%d bytes) in %v",
+				req.RemoteAddr, req.RequestLine.Method, req.RequestLine.RequestTarget,
+				w.StatusCode(), w.BodyBytes(), time.Since(start))
+		}
+	}
+}
+
+// Recover turns a panicking handler into a 500 response, logging the panic and
+// its stack. If the response had already started it is aborted instead, which
+// closes the connection. The server recovers panics itself, so this is only
+// needed to handle them before outer middleware sees the response.
+func Recover(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("Error: handler panicked: %v\n%s", v, debug.Stack())
+				writePanicResponse(w)
+			}
+		}()
+
+		next(w, req)
+	}
+}
+
+// RequestID gives every request an ID in the X-Request-ID header, keeping one
+// sent by the client or generating a random one. The ID is set on the request
+// for handlers to read and echoed in the response.
+func RequestID(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		id, ok := req.Headers.Get(RequestIDHeader)
+		if !ok || id == "" {
+			id = newRequestID()
+			req.Headers.Override(RequestIDHeader, id)
+		}
+		w.Header().Override(RequestIDHeader, id)
+
+		next(w, req)
+	}
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Timing calls record with how long the handler took and the status it wrote,
+// e.g. to feed request metrics.
+func Timing(record func(req *request.Request, statusCode response.StatusCode, elapsed time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			record(req, w.StatusCode(), time.Since(start))
+		}
+	}
+}
+
+// Compress compresses response bodies with the best content coding the
+// request's Accept-Encoding allows, as chosen by response.NegotiateEncoding.
+// Bodies shorter than minSize bytes, or response.DefaultMinCompressSize if it
+// is zero, and media types that are compressed already are sent as they are.
+// See response.Writer.SetCompression for how each kind of body is handled.
+func Compress(minSize int) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			acceptEncoding, _ := req.Headers.Get("Accept-Encoding")
+			w.SetCompression(response.NegotiateEncoding(acceptEncoding), minSize)
+
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tagMiddleware appends name to the X-Trace request header on the way in, so
+// tests can see the order middleware ran in.
+func tagMiddleware(name string) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			req.Headers.Add("X-Trace", name)
+			next(w, req)
+		}
+	}
+}
+
+func traceHandler(w *response.Writer, req *request.Request) {
+	trace, _ := req.Headers.Get("X-Trace")
+	_ = response.Write(w, response.StatusOK, response.GetDefaultHeaders(), []byte(trace))
+}
+
+func TestChain(t *testing.T) {
+	t.Run("First middleware is outermost", func(t *testing.T) {
+		h := Chain(traceHandler, tagMiddleware("a"), tagMiddleware("b"), tagMiddleware("c"))
+
+		var buf bytes.Buffer
+		req := request.NewRequest("GET", "/", nil)
+		h(response.NewWriter(&buf), req)
+
+		assert.Contains(t, buf.String(), "\r\n\r\na, b, c")
+	})
+
+	t.Run("Server and mux middleware", func(t *testing.T) {
+		m := NewMux()
+		m.Handle("/", traceHandler)
+		m.Use(tagMiddleware("mux"))
+
+		s, addr := startTestServer(t, m.Route)
+		s.Use(tagMiddleware("server"))
+
+		resp, err := http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, "server, mux", string(body))
+
+		// The mux's 404 goes through its middleware too
+		resp, err = http.Get("http://" + addr + "/missing")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Mux Use while serving", func(t *testing.T) {
+		m := NewMux()
+		m.Handle("/", traceHandler)
+
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Go(func() {
+				for range 50 {
+					var buf bytes.Buffer
+					req := request.NewRequest("GET", "/", nil)
+					m.Route(req)(response.NewWriter(&buf), req)
+				}
+			})
+		}
+		for range 50 {
+			m.Use(tagMiddleware("late"))
+		}
+		wg.Wait()
+
+		var buf bytes.Buffer
+		req := request.NewRequest("GET", "/", nil)
+		m.Route(req)(response.NewWriter(&buf), req)
+		assert.Equal(t, 50, strings.Count(buf.String(), "late"))
+	})
+}
+
+func TestBuiltinMiddleware(t *testing.T) {
+	t.Run("Logger", func(t *testing.T) {
+		var buf bytes.Buffer
+		h := Chain(okHandler, Logger(log.New(&buf, "", 0)))
+
+		req := request.NewRequest("GET", "/things?x=1", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		h(response.NewWriter(io.Discard), req)
+
+		assert.True(t, strings.HasPrefix(buf.String(), "10.0.0.1:1234 GET /things?x=1 -> 200 (2 bytes) in "), buf.String())
+	})
+
+	t.Run("Recover before response started", func(t *testing.T) {
+		panicking := func(w *response.Writer, req *request.Request) { panic("boom") }
+		_, addr := startTestServer(t, func(req *request.Request) Handler { return Chain(panicking, Recover) })
+
+		resp, err := http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.True(t, resp.Close)
+	})
+
+	t.Run("Recover after response started", func(t *testing.T) {
+		panicking := func(w *response.Writer, req *request.Request) {
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			_ = response.StartStream(w, response.StatusOK, h)
+			_, _ = w.Write([]byte("partial"))
+			panic("boom")
+		}
+		_, addr := startTestServer(t, func(req *request.Request) Handler { return Chain(panicking, Recover) })
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+
+		// The chunked body is cut off rather than completed
+		_, err = io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("RequestID generated", func(t *testing.T) {
+		var seen string
+		h := Chain(func(w *response.Writer, req *request.Request) {
+			seen, _ = req.Headers.Get(RequestIDHeader)
+			okHandler(w, req)
+		}, RequestID)
+
+		var buf bytes.Buffer
+		h(response.NewWriter(&buf), request.NewRequest("GET", "/", nil))
+
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err)
+		assert.Len(t, seen, 32)
+		assert.Equal(t, seen, resp.Header.Get(RequestIDHeader))
+	})
+
+	t.Run("RequestID kept from client", func(t *testing.T) {
+		req := request.NewRequest("GET", "/", nil)
+		req.Headers.Set(RequestIDHeader, "client-id")
+
+		var buf bytes.Buffer
+		Chain(okHandler, RequestID)(response.NewWriter(&buf), req)
+
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err)
+		assert.Equal(t, "client-id", resp.Header.Get(RequestIDHeader))
+	})
+
+	t.Run("Timing", func(t *testing.T) {
+		var (
+			mu      sync.Mutex
+			status  response.StatusCode
+			elapsed time.Duration
+		)
+		slow := func(w *response.Writer, req *request.Request) {
+			time.Sleep(10 * time.Millisecond)
+			okHandler(w, req)
+		}
+		h := Chain(slow, Timing(func(req *request.Request, statusCode response.StatusCode, d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			status, elapsed = statusCode, d
+		}))
+
+		h(response.NewWriter(io.Discard), request.NewRequest("GET", "/", nil))
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, response.StatusOK, status)
+		assert.GreaterOrEqual(t, elapsed, 10*time.Millisecond)
+	})
+	t.Run("Compress", func(t *testing.T) {
+		text := strings.Repeat("compress me ", 200)
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			return Chain(func(w *response.Writer, req *request.Request) {
+				_ = response.Write(w, response.StatusOK, response.GetDefaultHeaders(), []byte(text))
+			}, Compress(0))
+		})
+
+		// The client asks for gzip and decompresses transparently
+		resp, err := http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.True(t, resp.Uncompressed)
+		assert.Equal(t, text, string(body))
+
+		req, err := http.NewRequest("GET", "http://"+addr+"/", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Equal(t, text, string(body))
+	})
+}
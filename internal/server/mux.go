@@ -0,0 +1,319 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+)
+
+type segmentKind int
+
+// Segment kinds are ordered from most to least specific
+const (
+	literalSegment segmentKind = iota
+	paramSegment
+	wildcardSegment
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the literal text, or the wildcard name for the other kinds
+	value string
+}
+
+type route struct {
+	pattern  string
+	method   string
+	segments []segment
+	handler  Handler
+}
+
+// Mux routes requests to handlers by method and path pattern. A pattern is an
+// optional method followed by a path, such as "GET /users/{id}" or "/health".
+// Path segments are matched exactly, except for wildcards:
+//
+//   - {name} matches a single non-empty segment
+//   - {name...} must come last and matches the rest of the path, slashes
+//     included
+//
+// Matched values are read with req.PathValue. When several patterns match, the
+// most specific one wins: literal segments beat {name}, which beats {name...},
+// and a pattern with a method beats one without. A GET pattern also matches
+// HEAD requests.
+//
+// Requests no pattern matches get a 404, or the NotFound handler if set.
+// Requests whose path matches but whose method does not get a 405 with an
+// Allow header listing the methods that would have matched.
+//
+// Its Route method has the Router signature, so a Mux is served with
+// server.Serve(port, mux.Route).
+type Mux struct {
+	// NotFound handles requests that match no pattern. Defaults to a plain 404.
+	NotFound Handler
+
+	routes []route
+
+	mu         sync.Mutex
+	middleware []Middleware
+}
+
+func NewMux() *Mux {
+	return &Mux{}
+}
+
+// Handle registers handler for pattern. It panics if the pattern is malformed
+// or conflicts with one already registered, as both are programming errors.
+func (m *Mux) Handle(pattern string, handler Handler) {
+	r, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("server: invalid pattern %q: %v", pattern, err))
+	}
+	if handler == nil {
+		panic(fmt.Sprintf("server: nil handler for pattern %q", pattern))
+	}
+
+	for _, existing := range m.routes {
+		if existing.method == r.method && sameShape(existing.segments, r.segments) {
+			panic(fmt.Sprintf("server: pattern %q conflicts with %q", pattern, existing.pattern))
+		}
+	}
+
+	r.handler = handler
+	m.routes = append(m.routes, r)
+}
+
+// Route picks the handler for req and sets its path values. It never returns
+// nil.
+func (m *Mux) Route(req *request.Request) Handler {
+	m.mu.Lock()
+	middleware := m.middleware
+	m.mu.Unlock()
+
+	return Chain(m.match(req), middleware...)
+}
+
+func (m *Mux) match(req *request.Request) Handler {
+	parts, ok := pathSegments(req)
+	if !ok {
+		return m.notFound()
+	}
+
+	var (
+		best       *route
+		bestValues map[string]string
+		allowed    []string
+	)
+	for i := range m.routes {
+		r := &m.routes[i]
+		values, ok := r.match(parts)
+		if !ok {
+			continue
+		}
+
+		if !r.allows(req.RequestLine.Method) {
+			allowed = append(allowed, r.method)
+			if r.method == "GET" {
+				allowed = append(allowed, "HEAD")
+			}
+			continue
+		}
+
+		if best == nil || r.moreSpecific(best, req.RequestLine.Method) {
+			best = r
+			bestValues = values
+		}
+	}
+
+	if best != nil {
+		for name, value := range bestValues {
+			req.SetPathValue(name, value)
+		}
+		return best.handler
+	}
+
+	if len(allowed) > 0 {
+		slices.Sort(allowed)
+		return methodNotAllowedHandler(slices.Compact(allowed))
+	}
+	return m.notFound()
+}
+
+func (m *Mux) notFound() Handler {
+	if m.NotFound != nil {
+		return m.NotFound
+	}
+	return notFoundHandler
+}
+
+func notFoundHandler(w *response.Writer, req *request.Request) {
+	_ = response.Write(w, response.StatusNotFound, response.GetDefaultHeaders(), []byte(response.StatusText(response.StatusNotFound)))
+}
+
+func methodNotAllowedHandler(allowed []string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		headers := response.GetDefaultHeaders()
+		headers.Set("Allow", strings.Join(allowed, ", "))
+		_ = response.Write(w, response.StatusMethodNotAllowed, headers, []byte(response.StatusText(response.StatusMethodNotAllowed)))
+	}
+}
+
+// pathSegments splits the request's path into the decoded segments patterns
+// are matched against. Splitting happens before decoding, so an encoded slash
+// stays part of its segment. It reports false for targets that are not a path.
+func pathSegments(req *request.Request) ([]string, bool) {
+	rawPath := req.Target.RawPath
+	if !strings.HasPrefix(rawPath, "/") {
+		return nil, false
+	}
+
+	parts := strings.Split(rawPath[1:], "/")
+	for i, part := range parts {
+		decoded, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, false
+		}
+		parts[i] = decoded
+	}
+	return parts, true
+}
+
+func parsePattern(pattern string) (route, error) {
+	r := route{pattern: pattern}
+
+	path := pattern
+	if method, rest, ok := strings.Cut(pattern, " "); ok {
+		r.method = method
+		path = strings.TrimLeft(rest, " ")
+		if method == "" || strings.ToUpper(method) != method {
+			return route{}, fmt.Errorf("method %q must be uppercase", method)
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		return route{}, fmt.Errorf("path must start with /")
+	}
+
+	names := make(map[string]bool)
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") && !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return route{}, fmt.Errorf("segment %q mixes text and a wildcard", part)
+			}
+			r.segments = append(r.segments, segment{kind: literalSegment, value: part})
+			continue
+		}
+
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			return route{}, fmt.Errorf("segment %q mixes text and a wildcard", part)
+		}
+
+		name := part[1 : len(part)-1]
+		kind := paramSegment
+		if base, ok := strings.CutSuffix(name, "..."); ok {
+			if i != len(parts)-1 {
+				return route{}, fmt.Errorf("%s must be the last segment", part)
+			}
+			name = base
+			kind = wildcardSegment
+		}
+
+		if name == "" || strings.ContainsAny(name, "{}.") {
+			return route{}, fmt.Errorf("invalid wildcard name in %q", part)
+		}
+		if names[name] {
+			return route{}, fmt.Errorf("duplicate wildcard name %q", name)
+		}
+		names[name] = true
+
+		r.segments = append(r.segments, segment{kind: kind, value: name})
+	}
+
+	return r, nil
+}
+
+// match reports whether the path segments in parts match the route, returning
+// the wildcard values if so.
+func (r *route) match(parts []string) (map[string]string, bool) {
+	var values map[string]string
+	setValue := func(name, value string) {
+		if values == nil {
+			values = make(map[string]string)
+		}
+		values[name] = value
+	}
+
+	for i, seg := range r.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case literalSegment:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case paramSegment:
+			if parts[i] == "" {
+				return nil, false
+			}
+			setValue(seg.value, parts[i])
+		case wildcardSegment:
+			setValue(seg.value, strings.Join(parts[i:], "/"))
+			return values, true
+		}
+	}
+
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+	return values, true
+}
+
+func (r *route) allows(method string) bool {
+	return r.method == "" || r.method == method || (r.method == "GET" && method == "HEAD")
+}
+
+// moreSpecific reports whether r should win over other when both match the same
+// request with method.
+func (r *route) moreSpecific(other *route, method string) bool {
+	for i := range min(len(r.segments), len(other.segments)) {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	// Both can only match with the same number of segments unless one ends in
+	// {name...}, in which case the longer one is more specific
+	if len(r.segments) != len(other.segments) {
+		return len(r.segments) > len(other.segments)
+	}
+	return r.methodRank(method) > other.methodRank(method)
+}
+
+// methodRank orders how closely the route's method matches method: exactly,
+// as GET standing in for HEAD, or as a pattern without a method.
+func (r *route) methodRank(method string) int {
+	switch r.method {
+	case method:
+		return 2
+	case "":
+		return 0
+	default:
+		return 1
+	}
+}
+
+// sameShape reports whether two patterns match exactly the same paths, which
+// is the case when they only differ in wildcard names.
+func sameShape(a, b []segment) bool {
+	return slices.EqualFunc(a, b, func(x, y segment) bool {
+		if x.kind != y.kind {
+			return false
+		}
+		return x.kind != literalSegment || x.value == y.value
+	})
+}
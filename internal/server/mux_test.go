@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// textHandler answers with body, followed by the value of each named path
+// wildcard in names.
+func textHandler(body string, names ...string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		msg := body
+		for _, name := range names {
+			msg += " " + name + "=" + req.PathValue(name)
+		}
+		_ = response.Write(w, response.StatusOK, response.GetDefaultHeaders(), []byte(msg))
+	}
+}
+
+// routeRequest runs the handler m picks for a method and target and returns the
+// response it wrote along with its body.
+func routeRequest(t *testing.T, m *Mux, method, target string) (*http.Response, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	req := request.NewRequest(method, target, nil)
+	m.Route(req)(response.NewWriter(&buf), req)
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestMux(t *testing.T) {
+	m := NewMux()
+	m.Handle("/", textHandler("root"))
+	m.Handle("GET /users", textHandler("list users"))
+	m.Handle("POST /users", textHandler("create user"))
+	m.Handle("GET /users/{id}", textHandler("get user", "id"))
+	m.Handle("GET /users/me", textHandler("get me"))
+	m.Handle("DELETE /users/{id}", textHandler("delete user", "id"))
+	m.Handle("/users/{id}/posts/{post}", textHandler("post", "id", "post"))
+	m.Handle("/files/{path...}", textHandler("file", "path"))
+	m.Handle("GET /files/readme", textHandler("readme"))
+	m.Handle("HEAD /head", textHandler("head"))
+	m.Handle("GET /head", textHandler("get"))
+
+	t.Run("Literal, method and parameter matches", func(t *testing.T) {
+		tests := []struct {
+			method, target, want string
+		}{
+			{"GET", "/", "root"},
+			{"GET", "/users", "list users"},
+			{"POST", "/users", "create user"},
+			{"GET", "/users/42", "get user id=42"},
+			{"GET", "/users/42?verbose=1", "get user id=42"},
+			{"DELETE", "/users/42", "delete user id=42"},
+			{"PUT", "/users/7/posts/9", "post id=7 post=9"},
+			{"HEAD", "/users", "list users"},
+			{"HEAD", "/head", "head"},
+		}
+
+		for _, tc := range tests {
+			resp, body := routeRequest(t, m, tc.method, tc.target)
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "%s %s", tc.method, tc.target)
+			assert.Equal(t, tc.want, body, "%s %s", tc.method, tc.target)
+		}
+	})
+
+	t.Run("Most specific pattern wins", func(t *testing.T) {
+		_, body := routeRequest(t, m, "GET", "/users/me")
+		assert.Equal(t, "get me", body)
+
+		_, body = routeRequest(t, m, "GET", "/files/readme")
+		assert.Equal(t, "readme", body)
+	})
+
+	t.Run("Path values are decoded", func(t *testing.T) {
+		_, body := routeRequest(t, m, "GET", "/users/a%20b")
+		assert.Equal(t, "get user id=a b", body)
+
+		// An encoded slash stays within its segment
+		_, body = routeRequest(t, m, "GET", "/users/a%2Fb")
+		assert.Equal(t, "get user id=a/b", body)
+
+		_, body = routeRequest(t, m, "GET", "http://example.com/users/7")
+		assert.Equal(t, "get user id=7", body)
+	})
+
+	t.Run("Wildcard tail", func(t *testing.T) {
+		_, body := routeRequest(t, m, "GET", "/files/a/b/c.txt")
+		assert.Equal(t, "file path=a/b/c.txt", body)
+
+		_, body = routeRequest(t, m, "GET", "/files/")
+		assert.Equal(t, "file path=", body)
+
+		resp, _ := routeRequest(t, m, "GET", "/files")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Unmatched path is 404", func(t *testing.T) {
+		for _, target := range []string{"/nope", "/users/42/extra", "/users//posts/1"} {
+			resp, _ := routeRequest(t, m, "GET", target)
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, target)
+		}
+	})
+
+	t.Run("Unmatched method is 405 with Allow", func(t *testing.T) {
+		resp, _ := routeRequest(t, m, "PATCH", "/users/42")
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		assert.Equal(t, "DELETE, GET, HEAD", resp.Header.Get("Allow"))
+
+		resp, _ = routeRequest(t, m, "DELETE", "/users")
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		assert.Equal(t, "GET, HEAD, POST", resp.Header.Get("Allow"))
+	})
+
+	t.Run("Custom NotFound", func(t *testing.T) {
+		m := NewMux()
+		m.NotFound = textHandler("missing")
+
+		_, body := routeRequest(t, m, "GET", "/anything")
+		assert.Equal(t, "missing", body)
+	})
+
+	t.Run("Served as a Router", func(t *testing.T) {
+		_, addr := startTestServer(t, m.Route)
+
+		resp, err := http.Get("http://" + addr + "/users/5")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, "get user id=5", string(body))
+	})
+}
+
+func TestMuxHandlePanics(t *testing.T) {
+	invalid := []string{
+		"",
+		"users",
+		"get /users",
+		"/users/{id",
+		"/users/id}",
+		"/users/x{id}",
+		"/users/{}",
+		"/files/{path...}/more",
+		"/users/{id}/posts/{id}",
+	}
+	for _, pattern := range invalid {
+		assert.Panics(t, func() { NewMux().Handle(pattern, okHandler) }, pattern)
+	}
+
+	t.Run("Conflicting patterns", func(t *testing.T) {
+		m := NewMux()
+		m.Handle("GET /users/{id}", okHandler)
+
+		assert.Panics(t, func() { m.Handle("GET /users/{name}", okHandler) })
+		assert.NotPanics(t, func() { m.Handle("POST /users/{name}", okHandler) })
+		assert.NotPanics(t, func() { m.Handle("/users/{name}", okHandler) })
+	})
+}
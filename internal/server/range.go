@@ -0,0 +1,290 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+)
+
+var (
+	// ErrInvalidRange is returned by ParseRange for a Range header that is
+	// malformed or not in bytes. Such a header is ignored and the whole
+	// content sent.
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrRangeNotSatisfiable is returned by ParseRange when none of the ranges
+	// overlap the content, which is answered with a 416.
+	ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+)
+
+// ByteRange is a part of some content, Length bytes long from offset Start.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// contentRange returns the Content-Range value for r within content of size
+// bytes.
+func (r ByteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses a Range header value, such as "bytes=0-99,-500", against
+// content of size bytes. Ranges that reach past the end are cut short and ones
+// starting past it are dropped, leaving ErrRangeNotSatisfiable if none are
+// left. The ranges are returned in the order they were asked for.
+func ParseRange(value string, size int64) ([]ByteRange, error) {
+	unit, spec, ok := strings.Cut(value, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, fmt.Errorf("%w: %q is not a byte range", ErrInvalidRange, value)
+	}
+
+	var ranges []ByteRange
+	parsed := 0
+	for spec := range strings.SplitSeq(spec, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parsed++
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidRange, spec)
+		}
+
+		if first == "" {
+			// A suffix range is the last n bytes
+			n, err := parseRangePos(last)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidRange, spec)
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, ByteRange{Start: size - n, Length: n})
+			continue
+		}
+
+		start, err := parseRangePos(first)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidRange, spec)
+		}
+		end := size - 1
+		if last != "" {
+			end, err = parseRangePos(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidRange, spec)
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, ByteRange{Start: start, Length: end - start + 1})
+	}
+
+	if parsed == 0 {
+		return nil, fmt.Errorf("%w: %q has no ranges", ErrInvalidRange, value)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%w: %q for %d bytes", ErrRangeNotSatisfiable, value, size)
+	}
+	return ranges, nil
+}
+
+func parseRangePos(s string) (int64, error) {
+	if s == "" || !isDigits(s) {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func isDigits(s string) bool {
+	for i := range len(s) {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeContent answers a GET or HEAD request with content, honouring Range
+// and If-Range. It advertises Accept-Ranges, sends a single range as a 206
+// with Content-Range, several as a 206 multipart/byteranges body, and
+// answers ranges past the end with a 416. Ranges adding up to more than the
+// content itself are ignored and the whole content sent, so overlapping
+// ranges cannot be used to multiply the response.
+//
+// Conditional requests are answered first: an ETag set in w.Header() and a
+// non-zero modTime, which is sent as Last-Modified, are checked against the
+// request's preconditions, giving a 304 or 412 if they fail. The same
+// validators are used to check If-Range.
+//
+// The Content-Type is taken from the name's extension, or sniffed from the
+// content, unless one is already set in w.Header(). HEAD requests get the
+// same headers as GET without the content being read.
+func ServeContent(w *response.Writer, req *request.Request, name string, modTime time.Time, content io.ReadSeeker) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("Error: could not seek in %s: %v", name, err)
+		writeStatus(w, response.StatusInternalServerError)
+		return
+	}
+
+	etag, _ := w.Header().Get("ETag")
+	if response.WriteConditional(w, req.RequestLine.Method, req.Headers, etag, modTime) {
+		return
+	}
+
+	contentType, ok := w.Header().Get("Content-Type")
+	if !ok {
+		contentType, _, err = detectContentType(name, content)
+		if err != nil {
+			log.Printf("Error: could not read %s: %v", name, err)
+			writeStatus(w, response.StatusInternalServerError)
+			return
+		}
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Accept-Ranges", "bytes")
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	var ranges []ByteRange
+	if rangeHeader, ok := req.Headers.Get("Range"); ok && rangeApplies(w, req, modTime) {
+		ranges, err = ParseRange(rangeHeader, size)
+		switch {
+		case errors.Is(err, ErrRangeNotSatisfiable):
+			h.Set("Content-Type", "text/plain")
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			_ = response.Write(w, response.StatusRangeNotSatisfiable, h, []byte(response.StatusText(response.StatusRangeNotSatisfiable)))
+			return
+		case err != nil:
+			ranges = nil
+		case rangesLength(ranges) > size:
+			ranges = nil
+		}
+	}
+
+	head := req.RequestLine.Method == "HEAD"
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		if err := response.StartStream(w, response.StatusOK, h); err != nil || head {
+			return
+		}
+		copyContent(w, name, content, ByteRange{Start: 0, Length: size})
+
+	case 1:
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Range", ranges[0].contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
+		if err := response.StartStream(w, response.StatusPartialContent, h); err != nil || head {
+			return
+		}
+		copyContent(w, name, content, ranges[0])
+
+	default:
+		serveMultipartRanges(w, h, name, content, contentType, size, ranges, head)
+	}
+}
+
+// rangeApplies reports whether the Range header should be honoured: only for
+// GET and HEAD, and only if an If-Range validator still matches the content.
+func rangeApplies(w *response.Writer, req *request.Request, modTime time.Time) bool {
+	if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		return false
+	}
+
+	ifRange, ok := req.Headers.Get("If-Range")
+	if !ok {
+		return true
+	}
+	ifRange = strings.TrimSpace(ifRange)
+
+	if strings.HasPrefix(ifRange, `"`) {
+		// Ranges can only be combined with a strong validator
+		etag, ok := w.Header().Get("ETag")
+		return ok && etag == ifRange
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Equal(modTime.Truncate(time.Second))
+}
+
+func rangesLength(ranges []ByteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	return total
+}
+
+// serveMultipartRanges sends several ranges as a multipart/byteranges body,
+// or only its headers if head is set. Every part header is known up front, so
+// the body gets a Content-Length.
+func serveMultipartRanges(w *response.Writer, h *headers.Headers, name string, content io.ReadSeeker, contentType string, size int64, ranges []ByteRange, head bool) {
+	boundary := newRequestID()
+
+	partHeaders := make([]string, len(ranges))
+	length := int64(len("\r\n--" + boundary + "--\r\n"))
+	for i, r := range ranges {
+		delim := "\r\n--" + boundary + "\r\n"
+		if i == 0 {
+			delim = "--" + boundary + "\r\n"
+		}
+		partHeaders[i] = delim + "Content-Type: " + contentType + "\r\nContent-Range: " + r.contentRange(size) + "\r\n\r\n"
+		length += int64(len(partHeaders[i])) + r.Length
+	}
+
+	h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if err := response.StartStream(w, response.StatusPartialContent, h); err != nil || head {
+		return
+	}
+
+	for i, r := range ranges {
+		if _, err := w.Write([]byte(partHeaders[i])); err != nil {
+			log.Printf("Error: could not send %s: %v", name, err)
+			return
+		}
+		if !copyContent(w, name, content, r) {
+			return
+		}
+	}
+	if _, err := w.Write([]byte("\r\n--" + boundary + "--\r\n")); err != nil {
+		log.Printf("Error: could not send %s: %v", name, err)
+	}
+}
+
+// copyContent writes r of content to the body, reporting whether it all got
+// through.
+func copyContent(w *response.Writer, name string, content io.ReadSeeker, r ByteRange) bool {
+	if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+		log.Printf("Error: could not seek in %s: %v", name, err)
+		return false
+	}
+	if _, err := io.CopyN(w, content, r.Length); err != nil {
+		log.Printf("Error: could not send %s: %v", name, err)
+		return false
+	}
+	return true
+}
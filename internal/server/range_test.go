@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	t.Run("Valid ranges", func(t *testing.T) {
+		tests := []struct {
+			value string
+			want  []ByteRange
+		}{
+			{"bytes=0-9", []ByteRange{{0, 10}}},
+			{"bytes=90-", []ByteRange{{90, 10}}},
+			{"bytes=-20", []ByteRange{{80, 20}}},
+			{"bytes=-500", []ByteRange{{0, 100}}},
+			{"bytes=50-500", []ByteRange{{50, 50}}},
+			{"Bytes = 0-0 , 99-99,,", []ByteRange{{0, 1}, {99, 1}}},
+			{"bytes=10-19,0-4,200-300", []ByteRange{{10, 10}, {0, 5}}},
+		}
+
+		for _, tc := range tests {
+			got, err := ParseRange(tc.value, 100)
+			require.NoError(t, err, tc.value)
+			assert.Equal(t, tc.want, got, tc.value)
+		}
+	})
+
+	t.Run("Invalid ranges", func(t *testing.T) {
+		for _, value := range []string{"bytes", "items=0-1", "bytes=", "bytes=,", "bytes=5", "bytes=9-1", "bytes=a-b", "bytes=-", "bytes=+1-2", "bytes=1--2"} {
+			_, err := ParseRange(value, 100)
+			assert.ErrorIs(t, err, ErrInvalidRange, value)
+		}
+	})
+
+	t.Run("Unsatisfiable ranges", func(t *testing.T) {
+		for _, value := range []string{"bytes=100-", "bytes=100-200,300-400", "bytes=-0"} {
+			_, err := ParseRange(value, 100)
+			assert.ErrorIs(t, err, ErrRangeNotSatisfiable, value)
+		}
+		_, err := ParseRange("bytes=-10", 0)
+		assert.ErrorIs(t, err, ErrRangeNotSatisfiable)
+	})
+}
+
+// contentRequest serves content with ServeContent for a GET with the given
+// header fields, given as name, value pairs.
+func contentRequest(t *testing.T, content string, modTime time.Time, fields ...string) (*http.Response, string) {
+	t.Helper()
+
+	m := NewMux()
+	m.Handle("GET /content", func(w *response.Writer, req *request.Request) {
+		for i := 0; i < len(fields); i += 2 {
+			req.Headers.Add(fields[i], fields[i+1])
+		}
+		ServeContent(w, req, "content.txt", modTime, strings.NewReader(content))
+	})
+	return routeRequest(t, m, "GET", "/content")
+}
+
+func TestServeContent(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Whole content", func(t *testing.T) {
+		resp, body := contentRequest(t, content, modTime)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+		assert.Equal(t, "20", resp.Header.Get("Content-Length"))
+		assert.Equal(t, content, body)
+	})
+
+	t.Run("Single range", func(t *testing.T) {
+		resp, body := contentRequest(t, content, modTime, "Range", "bytes=5-9")
+		assert.Equal(t, 206, resp.StatusCode)
+		assert.Equal(t, "bytes 5-9/20", resp.Header.Get("Content-Range"))
+		assert.Equal(t, "5", resp.Header.Get("Content-Length"))
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "56789", body)
+
+		resp, body = contentRequest(t, content, modTime, "Range", "bytes=-3")
+		assert.Equal(t, 206, resp.StatusCode)
+		assert.Equal(t, "bytes 17-19/20", resp.Header.Get("Content-Range"))
+		assert.Equal(t, "hij", body)
+	})
+
+	t.Run("Multiple ranges", func(t *testing.T) {
+		resp, body := contentRequest(t, content, modTime, "Range", "bytes=0-1,10-12,-2")
+		assert.Equal(t, 206, resp.StatusCode)
+
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		assert.Equal(t, "multipart/byteranges", mediaType)
+
+		mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+		var parts []string
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(part)
+			require.NoError(t, err)
+			assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+			parts = append(parts, part.Header.Get("Content-Range")+" "+string(data))
+		}
+		assert.Equal(t, []string{"bytes 0-1/20 01", "bytes 10-12/20 abc", "bytes 18-19/20 ij"}, parts)
+	})
+
+	t.Run("Not satisfiable", func(t *testing.T) {
+		resp, _ := contentRequest(t, content, modTime, "Range", "bytes=20-")
+		assert.Equal(t, 416, resp.StatusCode)
+		assert.Equal(t, "bytes */20", resp.Header.Get("Content-Range"))
+	})
+
+	t.Run("Ignored ranges", func(t *testing.T) {
+		for _, value := range []string{"lines=1-2", "bytes=5-1", "bytes=0-19,0-19"} {
+			resp, body := contentRequest(t, content, modTime, "Range", value)
+			assert.Equal(t, 200, resp.StatusCode, value)
+			assert.Equal(t, content, body, value)
+		}
+	})
+
+	t.Run("If-Range", func(t *testing.T) {
+		resp, body := contentRequest(t, content, modTime, "Range", "bytes=0-1", "If-Range", "Wed, 01 May 2024 12:00:00 GMT")
+		assert.Equal(t, 206, resp.StatusCode)
+		assert.Equal(t, "01", body)
+
+		resp, body = contentRequest(t, content, modTime, "Range", "bytes=0-1", "If-Range", "Tue, 30 Apr 2024 12:00:00 GMT")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, content, body)
+
+		// Without an ETag an entity-tag can never match
+		resp, _ = contentRequest(t, content, modTime, "Range", "bytes=0-1", "If-Range", `"abc"`)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("HEAD does not read the content", func(t *testing.T) {
+		for _, value := range []string{"", "bytes=5-9", "bytes=0-1,10-12"} {
+			content := &countingReader{ReadSeeker: strings.NewReader(content)}
+			req := request.NewRequest("HEAD", "/content", nil)
+			if value != "" {
+				req.Headers.Add("Range", value)
+			}
+			var buf bytes.Buffer
+			w := response.NewWriter(&buf)
+			w.SetRequestMethod("HEAD")
+			w.Header().Set("Content-Type", "text/plain")
+			ServeContent(w, req, "content.txt", modTime, content)
+
+			assert.True(t, w.Done(), value)
+			assert.Zero(t, content.n, value)
+			resp, err := http.ReadResponse(bufio.NewReader(&buf), &http.Request{Method: "HEAD"})
+			require.NoError(t, err, value)
+			assert.NotEmpty(t, resp.Header.Get("Content-Length"), value)
+		}
+	})
+
+	t.Run("File server", func(t *testing.T) {
+		m := NewMux()
+		m.Handle("GET /{path...}", (&FileServer{Root: fstest.MapFS{"video.mp4": {Data: []byte(content)}}}).Serve)
+
+		req := request.NewRequest("GET", "/video.mp4", nil)
+		req.Headers.Add("Range", "bytes=10-")
+		var buf bytes.Buffer
+		m.Route(req)(response.NewWriter(&buf), req)
+
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, 206, resp.StatusCode)
+		assert.Equal(t, "bytes 10-19/20", resp.Header.Get("Content-Range"))
+		assert.Equal(t, "abcdefghij", string(body))
+	})
+}
+
+// countingReader counts the bytes read from a ReadSeeker.
+type countingReader struct {
+	io.ReadSeeker
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.n += n
+	return n, err
+}
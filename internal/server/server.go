@@ -2,10 +2,19 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/bailey4770/httpfromtcp/internal/headers"
 	"github.com/bailey4770/httpfromtcp/internal/request"
 	"github.com/bailey4770/httpfromtcp/internal/response"
 )
@@ -15,39 +24,137 @@ type (
 	Handler func(w *response.Writer, req *request.Request)
 )
 
+var (
+	// ErrServerClosed is the context cause for requests cancelled because the
+	// server was closed, or shut down past its deadline.
+	ErrServerClosed = errors.New("server closed")
+	// ErrClientDisconnected is the context cause for requests cancelled because
+	// the client closed the connection while the handler was running.
+	ErrClientDisconnected = errors.New("client disconnected")
+)
+
 type Server struct {
-	listener net.Listener
-	isClosed atomic.Bool
-	router   Router
+	listeners []net.Listener
+	isClosed  atomic.Bool
+	router    Router
+	config    Config
+	tlsConfig *tls.Config
+
+	// ctx is the parent of every request context, cancelled on Close
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mu         sync.Mutex
+	conns      map[net.Conn]connState
+	middleware []Middleware
 }
 
+// Serve listens for TCP connections on port across all interfaces.
 func Serve(port int, router Router) (*Server, error) {
-	listener, err := net.Listen("tcp", ":42069")
+	return ServeConfig(Config{Addr: ":" + strconv.Itoa(port)}, router)
+}
+
+// ServeConfig listens on the network and address in cfg and serves connections
+// in the background until the server is closed.
+func ServeConfig(cfg Config, router Router) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	listener, err := cfg.listen()
 	if err != nil {
 		return nil, err
 	}
 
+	server, err := ServeListener(listener, cfg, router)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+// ServeListener serves connections accepted from an existing listener, e.g.
+// one inherited through socket activation. cfg.Network and cfg.Addr are
+// ignored. The server takes ownership of the listener and closes it on
+// Close or Shutdown. If cfg is invalid an error is returned and the listener
+// is left open for the caller.
+func ServeListener(listener net.Listener, cfg Config, router Router) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
 	server := &Server{
-		listener: listener,
-		isClosed: atomic.Bool{},
-		router:   router,
+		isClosed:  atomic.Bool{},
+		router:    router,
+		config:    cfg,
+		tlsConfig: cfg.tlsConfig(),
+		ctx:       ctx,
+		cancel:    cancel,
+		conns:     make(map[net.Conn]connState),
 	}
 	server.isClosed.Store(false)
 
-	go server.listen()
+	server.AddListener(listener)
 	return server, nil
 }
 
+// AddListener serves connections from an additional listener, so a single
+// server can accept on several interfaces or sockets at once. With a TLSConfig
+// the listener's connections are served over TLS as well.
+func (s *Server) AddListener(listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed.Load() {
+		_ = listener.Close()
+		return
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listeners = append(s.listeners, listener)
+	go s.listen(listener)
+}
+
+// Addr returns the address of the first listener the server was started with.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.listeners[0].Addr()
+}
+
+// Close stops accepting connections and immediately closes every open one,
+// including those with a handler still running. Use Shutdown to let in-flight
+// requests finish first.
 func (s *Server) Close() error {
 	s.isClosed.Store(true)
-	return s.listener.Close()
+	err := s.closeListeners()
+	s.cancel(ErrServerClosed)
+	s.closeAllConns()
+	return err
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, listener := range s.listeners {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (s *Server) listen() {
+func (s *Server) listen(listener net.Listener) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			if s.isClosed.Load() {
+			if s.isClosed.Load() || errors.Is(err, net.ErrClosed) {
 				return
 			}
 			log.Printf("Error: could not accept connection: %v", err)
@@ -55,24 +162,222 @@ func (s *Server) listen() {
 		}
 		log.Print("Connection accepted")
 
+		if !s.trackConn(conn) {
+			_ = conn.Close()
+			continue
+		}
 		go s.handle(conn)
 	}
 }
 
+// handle serves requests from conn until either side asks to close it or a
+// response cannot be framed for reuse. Pipelined requests are read one at a time
+// after the previous handler returns, so responses go out in request order.
 func (s *Server) handle(conn net.Conn) {
-	defer func() { _ = conn.Close() }()
+	defer func() {
+		// Handler panics are answered by serveRequest, so this only catches
+		// ones while reading requests, which take down just this connection
+		if v := recover(); v != nil {
+			log.Printf("Error: panic serving connection from %s: %v\n%s", conn.RemoteAddr(), v, debug.Stack())
+		}
+		s.untrackConn(conn)
+		_ = conn.Close()
+	}()
 
-	w := &response.Writer{Conn: conn}
+	reader := request.NewReader(conn)
+	reader.Limits = s.config.Limits
 
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		headers := response.GetDefaultHeaders()
-		response.Write(w, response.StatusBadRequest, headers, []byte(err.Error()))
-		return
+	// A fresh connection gets the header timeout to send its first byte, later
+	// ones get the idle timeout between requests
+	waitTimeout := s.config.readHeaderTimeout()
+
+	for {
+		w := response.NewWriter(conn)
+
+		_ = conn.SetReadDeadline(deadline(time.Now(), waitTimeout))
+		if err := reader.WaitForRequest(); err != nil {
+			if !errors.Is(err, io.EOF) && !isTimeout(err) {
+				log.Printf("Error: could not read from connection: %v", err)
+			}
+			log.Print("Closing idle connection")
+			return
+		}
+		waitTimeout = s.config.idleTimeout()
+
+		// Shutdown may have closed this connection while it was idle, in which
+		// case the request cannot be answered
+		if !s.setConnState(conn, stateActive) {
+			return
+		}
+
+		start := time.Now()
+		_ = conn.SetReadDeadline(deadline(start, s.config.readHeaderTimeout()))
+		req, err := reader.ReadHeader()
+		if err != nil {
+			s.writeReadError(w, conn, err)
+			return
+		}
+
+		req.RemoteAddr = conn.RemoteAddr().String()
+		w.SetRequestVersion(req.RequestLine.ProtoMajor, req.RequestLine.ProtoMinor)
+		w.SetRequestMethod(req.RequestLine.Method)
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			// The handshake is done by now, as it happens on the first read
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
+
+		// The handler streams the body itself, so ReadTimeout keeps applying to
+		// its reads. Holding on to the body lets it be drained even if a handler
+		// swaps req.BodyReader out
+		body := req.BodyReader
+		req, finishContext := s.requestContext(conn, reader, req)
+		_ = conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+		_ = conn.SetReadDeadline(deadline(start, s.config.ReadTimeout))
+
+		if !req.KeepAlive() || s.isClosed.Load() {
+			w.CloseConnection()
+		}
+
+		s.serveRequest(w, req)
+		finishContext()
+		if err := req.RemoveMultipartFiles(); err != nil {
+			log.Printf("Error: could not remove multipart files: %v", err)
+		}
+
+		bodyErr := body.Close()
+		switch {
+		case errors.Is(bodyErr, request.ErrBodyNotConsumed):
+			// The request itself was fine, there is just too much of it left
+			// to skip to the next one
+			w.CloseConnection()
+		case bodyErr != nil && !w.Started():
+			s.writeReadError(w, conn, bodyErr)
+			return
+		}
+
+		finishResponse(w)
+
+		if bodyErr != nil {
+			return
+		}
+
+		if !w.KeepAlive() {
+			log.Print("Successfuly wrote response and closed connection")
+			return
+		}
+		log.Print("Successfuly wrote response, keeping connection alive")
+
+		if !s.setConnState(conn, stateIdle) {
+			return
+		}
+	}
+}
+
+// requestContext gives req a context derived from the server's, bounded by
+// HandlerTimeout and cancelled if the client disconnects while the handler
+// runs. The returned function stops watching the connection and releases the
+// context; it must be called once the handler returns.
+func (s *Server) requestContext(conn net.Conn, reader *request.Reader, req *request.Request) (*request.Request, func()) {
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	var cancelTimeout context.CancelFunc = func() {}
+	if s.config.HandlerTimeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.config.HandlerTimeout)
+	}
+
+	watcher := newDisconnectWatcher(conn, reader, cancel)
+	// Until the body has been read the handler owns reads from the connection,
+	// so watching only starts once it is done
+	if req.BodyComplete() {
+		watcher.start()
+	} else {
+		req.BodyReader = &watchedBody{ReadCloser: req.BodyReader, onEOF: watcher.start}
+	}
+
+	return req.WithContext(ctx), func() {
+		watcher.stop()
+		cancelTimeout()
+		cancel(context.Canceled)
 	}
+}
+
+// serveRequest routes req and runs its handler. A panic in either is recovered
+// so it only takes down this connection, not the whole process.
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			stack := debug.Stack()
+			log.Printf("Error: panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, v, stack)
+			if s.config.OnPanic != nil {
+				s.config.OnPanic(req, v, stack)
+			}
+			writePanicResponse(w)
+		}
+	}()
 
-	handler := s.router(req)
+	handler := s.route(req)
 	handler(w, req)
+}
+
+// writePanicResponse answers a request whose handler panicked. If nothing was
+// written yet the client gets a 500, otherwise the response is aborted. Either
+// way the connection is closed, as the handler may have left it in a bad state.
+func writePanicResponse(w *response.Writer) {
+	if w.Started() {
+		w.Abort()
+		return
+	}
+
+	w.CloseConnection()
+	statusCode := response.StatusInternalServerError
+	_ = response.Write(w, statusCode, response.GetDefaultHeaders(), []byte(response.StatusText(statusCode)))
+}
+
+// finishResponse completes whatever the handler left unwritten. A handler that
+// wrote nothing chose not to answer, which is a success with no content.
+func finishResponse(w *response.Writer) {
+	if !w.Started() {
+		_ = response.Write(w, response.StatusNoContent, headers.NewHeaders(), nil)
+		return
+	}
+
+	if err := w.Finish(); err != nil {
+		log.Printf("Error: handler left response incomplete: %v", err)
+	}
+}
+
+// writeReadError answers a request that could not be read and marks the
+// connection to be closed.
+func (s *Server) writeReadError(w *response.Writer, conn net.Conn, err error) {
+	log.Printf("Error: could not read request: %v", err)
+
+	w.CloseConnection()
+	headers := response.GetDefaultHeaders()
+	_ = conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+
+	var statusCode response.StatusCode
+	switch {
+	case isTimeout(err):
+		// The read deadline has passed but the client may still be listening
+		statusCode = response.StatusRequestTimeout
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		statusCode = response.StatusURITooLong
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		statusCode = response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		statusCode = response.StatusContentTooLarge
+	case errors.Is(err, request.ErrVersionNotSupported):
+		statusCode = response.StatusHTTPVersionNotSupported
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		statusCode = response.StatusNotImplemented
+	default:
+		statusCode = response.StatusBadRequest
+	}
+
+	_ = response.Write(w, statusCode, headers, []byte(response.StatusText(statusCode)))
+}
 
-	log.Print("Successfuly wrote response and closed connection")
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
@@ -0,0 +1,724 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/headers"
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer serves router on a random loopback port and returns the
+// server along with its address.
+func startTestServer(t *testing.T, router Router) (*Server, string) {
+	t.Helper()
+	return startTestServerConfig(t, Config{}, router)
+}
+
+// startTestServerConfig is startTestServer with extra config. cfg.Addr is
+// always replaced by a random loopback port.
+func startTestServerConfig(t *testing.T, cfg Config, router Router) (*Server, string) {
+	t.Helper()
+
+	cfg.Addr = "127.0.0.1:0"
+	s, err := ServeConfig(cfg, router)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s, s.Addr().String()
+}
+
+func okHandler(w *response.Writer, req *request.Request) {
+	response.Write(w, response.StatusOK, response.GetDefaultHeaders(), []byte("ok"))
+}
+
+// sendRequest writes a GET request for target to conn and reads the response.
+func sendRequest(t *testing.T, conn net.Conn, reader *bufio.Reader, target string) *http.Response {
+	t.Helper()
+
+	_, err := io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestListen(t *testing.T) {
+	t.Run("Serve uses requested port", func(t *testing.T) {
+		s, err := Serve(0, func(req *request.Request) Handler { return okHandler })
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		addr, ok := s.Addr().(*net.TCPAddr)
+		require.True(t, ok)
+		assert.NotEqual(t, 42069, addr.Port)
+	})
+
+	t.Run("Unix domain socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "server.sock")
+		s, err := ServeConfig(Config{Network: "unix", Addr: path}, func(req *request.Request) Handler { return okHandler })
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		resp := sendRequest(t, conn, bufio.NewReader(conn), "/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Pre-built listeners", func(t *testing.T) {
+		first, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		second, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s, err := ServeListener(first, Config{}, func(req *request.Request) Handler { return okHandler })
+		require.NoError(t, err)
+		s.AddListener(second)
+		defer func() { _ = s.Close() }()
+
+		for _, addr := range []string{first.Addr().String(), second.Addr().String()} {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+
+			resp := sendRequest(t, conn, bufio.NewReader(conn), "/")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			_ = conn.Close()
+		}
+	})
+}
+
+func TestIncompleteResponses(t *testing.T) {
+	t.Run("Handler that writes nothing gets 204", func(t *testing.T) {
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		reader := bufio.NewReader(conn)
+		resp := sendRequest(t, conn, reader, "/")
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = sendRequest(t, conn, reader, "/")
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("Unfinished chunked body is terminated", func(t *testing.T) {
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				h := headers.NewHeaders()
+				h.Set("Transfer-Encoding", "chunked")
+				_ = response.StartStream(w, response.StatusOK, h)
+				_, _ = w.Write([]byte("partial"))
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		reader := bufio.NewReader(conn)
+		resp := sendRequest(t, conn, reader, "/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.False(t, resp.Close)
+	})
+}
+
+func TestRequestBody(t *testing.T) {
+	t.Run("Handler runs before body arrives", func(t *testing.T) {
+		started := make(chan struct{})
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				close(started)
+				data, err := io.ReadAll(req.BodyReader)
+				assert.NoError(t, err)
+				response.Write(w, response.StatusOK, response.GetDefaultHeaders(), data)
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\n")
+		require.NoError(t, err)
+		<-started
+		_, err = io.WriteString(conn, "hello")
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	})
+
+	t.Run("Unread body is drained for next request", func(t *testing.T) {
+		_, addr := startTestServer(t, func(req *request.Request) Handler { return okHandler })
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello")
+		require.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.False(t, resp.Close)
+
+		resp = sendRequest(t, conn, reader, "/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Large unread body closes connection", func(t *testing.T) {
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		// The server stops reading part way through, so the write may never
+		// complete
+		body := strings.Repeat("a", 512<<10)
+		go func() {
+			_, _ = io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+		}()
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.True(t, resp.Close)
+	})
+
+	t.Run("Multipart files removed after handler", func(t *testing.T) {
+		dir := t.TempDir()
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			if req.RequestLine.Method != "POST" {
+				return okHandler
+			}
+			return func(w *response.Writer, req *request.Request) {
+				// A copy of the request parses the form, as middleware often makes
+				req = req.WithValue(struct{}{}, "copy")
+				err := req.ParseMultipartForm(request.MultipartLimits{MaxMemory: 4, TempDir: dir})
+				assert.NoError(t, err)
+
+				entries, err := os.ReadDir(dir)
+				assert.NoError(t, err)
+				assert.Len(t, entries, 1)
+				okHandler(w, req)
+			}
+		})
+
+		body := "--b\r\n" +
+			"Content-Disposition: form-data; name=\"upload\"; filename=\"a.txt\"\r\n" +
+			"\r\n" +
+			"spooled to disk\r\n" +
+			"--b--\r\n"
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=b\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+		require.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		// Once the next request is answered the first one is done with
+		resp = sendRequest(t, conn, reader, "/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("Large body closed by handler closes connection", func(t *testing.T) {
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				_ = req.BodyReader.Close()
+				okHandler(w, req)
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		// What is left of the body looks like a request of its own, which must
+		// never be answered
+		body := strings.Repeat("a", 300<<10) + "GET /smuggled HTTP/1.1\r\n\r\n"
+		go func() {
+			_, _ = io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+		}()
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = http.ReadResponse(reader, nil)
+		assert.Error(t, err)
+		assert.False(t, isTimeout(err), "connection was kept open")
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Run("Slow request line gets 408", func(t *testing.T) {
+		_, addr := startTestServerConfig(t, Config{ReadHeaderTimeout: 100 * time.Millisecond}, func(req *request.Request) Handler { return okHandler })
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "GET / HT")
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+		assert.True(t, resp.Close)
+	})
+
+	t.Run("Slow body gets 408", func(t *testing.T) {
+		_, addr := startTestServerConfig(t, Config{ReadTimeout: 100 * time.Millisecond}, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				if err := req.BufferBody(); err != nil {
+					return
+				}
+				okHandler(w, req)
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhalf")
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	})
+
+	t.Run("Idle connection closed silently", func(t *testing.T) {
+		_, addr := startTestServerConfig(t, Config{IdleTimeout: 100 * time.Millisecond}, func(req *request.Request) Handler { return okHandler })
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		reader := bufio.NewReader(conn)
+		resp := sendRequest(t, conn, reader, "/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, err = reader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestLimitStatusCodes(t *testing.T) {
+	cfg := Config{Limits: request.Limits{MaxRequestLineBytes: 64, MaxHeaderBytes: 64, MaxBodyBytes: 8}}
+	_, addr := startTestServerConfig(t, cfg, func(req *request.Request) Handler { return okHandler })
+
+	tests := []struct {
+		name       string
+		raw        string
+		statusCode int
+	}{
+		{"Long target", "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", http.StatusRequestURITooLong},
+		{"Large headers", "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 100) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"Large body", "POST / HTTP/1.1\r\nContent-Length: 100\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"Malformed", "GET / HTTP/1.1\r\nBad Header\r\n\r\n", http.StatusBadRequest},
+		{"Empty field name", "GET / HTTP/1.1\r\n: x\r\n\r\n", http.StatusBadRequest},
+		{"Missing version", "GET / HTTP\r\n\r\n", http.StatusBadRequest},
+		{"Bad percent-encoding", "GET /%zz HTTP/1.1\r\n\r\n", http.StatusBadRequest},
+		{"Unsupported version", "GET / HTTP/2.0\r\n\r\n", http.StatusHTTPVersionNotSupported},
+		{"Unsupported transfer coding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", http.StatusNotImplemented},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			_, err = io.WriteString(conn, tc.raw)
+			require.NoError(t, err)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			assert.Equal(t, tc.statusCode, resp.StatusCode)
+			assert.True(t, resp.Close)
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("Waits for active handler", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		s, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				close(started)
+				<-release
+				okHandler(w, req)
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		reader := bufio.NewReader(conn)
+		respCh := make(chan *http.Response, 1)
+		go func() {
+			defer close(respCh)
+			_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			resp, err := http.ReadResponse(reader, nil)
+			if err == nil {
+				_, _ = io.ReadAll(resp.Body)
+				respCh <- resp
+			}
+		}()
+		<-started
+
+		done := make(chan struct{})
+		var forceClosed int
+		go func() {
+			forceClosed, err = s.Shutdown(context.Background())
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("Shutdown returned while a handler was running")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(release)
+		<-done
+		require.NoError(t, err)
+		assert.Equal(t, 0, forceClosed)
+
+		resp := <-respCh
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// The connection is not reused once the server is shutting down
+		_, err = reader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Closes idle keep-alive connections", func(t *testing.T) {
+		s, addr := startTestServer(t, func(req *request.Request) Handler { return okHandler })
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		reader := bufio.NewReader(conn)
+		resp := sendRequest(t, conn, reader, "/")
+		assert.False(t, resp.Close)
+
+		forceClosed, err := s.Shutdown(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 0, forceClosed)
+
+		_, err = reader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Force closes after deadline", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+		s, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				close(started)
+				<-release
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		forceClosed, err := s.Shutdown(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 1, forceClosed)
+	})
+}
+
+func TestPanicRecovery(t *testing.T) {
+	t.Run("Panic before response started", func(t *testing.T) {
+		var (
+			mu       sync.Mutex
+			reported any
+			stack    []byte
+		)
+		cfg := Config{OnPanic: func(req *request.Request, value any, s []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported, stack = value, s
+		}}
+		_, addr := startTestServerConfig(t, cfg, func(req *request.Request) Handler {
+			if req.RequestLine.RequestTarget == "/router" {
+				panic("router boom")
+			}
+			return func(w *response.Writer, req *request.Request) { panic("handler boom") }
+		})
+
+		for target, want := range map[string]string{"/router": "router boom", "/handler": "handler boom"} {
+			resp, err := http.Get("http://" + addr + target)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+			assert.True(t, resp.Close)
+
+			mu.Lock()
+			assert.Equal(t, want, reported)
+			assert.Contains(t, string(stack), "panic")
+			mu.Unlock()
+		}
+	})
+
+	t.Run("Panic mid-stream closes connection", func(t *testing.T) {
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				h := headers.NewHeaders()
+				h.Set("Content-Length", "100")
+				_ = response.StartStream(w, response.StatusOK, h)
+				_, _ = w.Write([]byte("partial"))
+				panic("boom")
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, "partial", string(body))
+	})
+
+	t.Run("Server keeps serving after a panic", func(t *testing.T) {
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			if req.RequestLine.RequestTarget == "/panic" {
+				return func(w *response.Writer, req *request.Request) { panic("boom") }
+			}
+			return okHandler
+		})
+
+		resp, err := http.Get("http://" + addr + "/panic")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		resp, err = http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+func TestRequestContext(t *testing.T) {
+	// waitHandler blocks until the request context is done and sends its cause
+	// on causes.
+	waitHandler := func(causes chan<- error) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			_, _ = io.ReadAll(req.BodyReader)
+			select {
+			case <-req.Context().Done():
+				causes <- context.Cause(req.Context())
+			case <-time.After(5 * time.Second):
+				causes <- nil
+			}
+			okHandler(w, req)
+		}
+	}
+
+	t.Run("Cancelled on client disconnect", func(t *testing.T) {
+		for name, raw := range map[string]string{
+			"No body":   "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			"With body": "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello",
+		} {
+			causes := make(chan error, 1)
+			_, addr := startTestServer(t, func(req *request.Request) Handler { return waitHandler(causes) })
+
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			_, err = io.WriteString(conn, raw)
+			require.NoError(t, err)
+
+			time.Sleep(50 * time.Millisecond)
+			_ = conn.Close()
+
+			assert.ErrorIs(t, <-causes, ErrClientDisconnected, name)
+		}
+	})
+
+	t.Run("Handler timeout", func(t *testing.T) {
+		causes := make(chan error, 1)
+		_, addr := startTestServerConfig(t, Config{HandlerTimeout: 50 * time.Millisecond}, func(req *request.Request) Handler {
+			return waitHandler(causes)
+		})
+
+		resp, err := http.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.ErrorIs(t, <-causes, context.DeadlineExceeded)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Cancelled on server close", func(t *testing.T) {
+		causes := make(chan error, 1)
+		s, addr := startTestServer(t, func(req *request.Request) Handler { return waitHandler(causes) })
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, s.Close())
+
+		assert.ErrorIs(t, <-causes, ErrServerClosed)
+	})
+
+	t.Run("Not cancelled while connection stays open", func(t *testing.T) {
+		_, addr := startTestServer(t, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				time.Sleep(50 * time.Millisecond)
+				assert.NoError(t, req.Context().Err())
+				okHandler(w, req)
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		reader := bufio.NewReader(conn)
+
+		for range 2 {
+			resp := sendRequest(t, conn, reader, "/")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	})
+}
+
+func TestHTTP10(t *testing.T) {
+	chunked := func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		_ = response.StartStream(w, response.StatusOK, h)
+		_, _ = w.WriteChunkedBody([]byte("hello "))
+		_, _ = w.WriteChunkedBody([]byte("world"))
+	}
+	_, addr := startTestServer(t, func(req *request.Request) Handler {
+		if req.RequestLine.RequestTarget == "/chunked" {
+			return chunked
+		}
+		return okHandler
+	})
+
+	t.Run("Closes without keep-alive", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		reader := bufio.NewReader(conn)
+
+		_, err = io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(body))
+		assert.True(t, resp.Close)
+
+		_, err = reader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Keep-alive when asked", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		reader := bufio.NewReader(conn)
+
+		for range 2 {
+			_, err = io.WriteString(conn, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+			require.NoError(t, err)
+			resp, err := http.ReadResponse(reader, nil)
+			require.NoError(t, err)
+			_, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+			assert.False(t, resp.Close)
+		}
+	})
+
+	t.Run("No chunked responses", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.WriteString(conn, "GET /chunked HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+		require.NoError(t, err)
+		raw, err := io.ReadAll(conn)
+		require.NoError(t, err)
+
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello world", string(raw))
+	})
+}
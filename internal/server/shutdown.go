@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+type connState int
+
+const (
+	// stateIdle covers a connection waiting for its next request
+	stateIdle connState = iota
+	// stateActive covers a connection whose request is being handled
+	stateActive
+)
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops accepting new connections, closes idle keep-alive connections
+// and waits for in-flight handlers to finish. Connections still active when ctx
+// is done are closed forcibly and their request contexts cancelled; their
+// number is returned along with ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.isClosed.Store(true)
+	listenerErr := s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeIdleConns() == 0 {
+			return 0, listenerErr
+		}
+
+		select {
+		case <-ctx.Done():
+			s.cancel(ErrServerClosed)
+			return s.closeAllConns(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// trackConn registers a newly accepted connection as idle. It reports false if
+// the server is already closed, in which case the caller must drop the conn.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed.Load() {
+		return false
+	}
+	s.conns[conn] = stateIdle
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// setConnState records a state transition for conn. It reports false if the
+// connection has been closed by Shutdown or Close in the meantime.
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.conns[conn]; !ok {
+		return false
+	}
+	if state == stateIdle && s.isClosed.Load() {
+		delete(s.conns, conn)
+		return false
+	}
+	s.conns[conn] = state
+	return true
+}
+
+// closeIdleConns closes connections waiting for their next request and returns
+// how many active connections remain.
+func (s *Server) closeIdleConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, state := range s.conns {
+		if state == stateIdle {
+			_ = conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns)
+}
+
+// closeAllConns closes every tracked connection and returns how many there were.
+func (s *Server) closeAllConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	closed := len(s.conns)
+	for conn := range s.conns {
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+	return closed
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultReloadInterval is how often a CertReloader checks its files for
+// changes when ReloadInterval is not set.
+const defaultReloadInterval = 10 * time.Second
+
+// ServeTLS is ServeConfig for HTTPS, serving the certificate and key in
+// certFile and keyFile. The files are reloaded when they change on disk, so
+// renewed certificates are picked up without a restart. Further certificates
+// for other names can be loaded into cfg.TLSConfig.Certificates as usual: they
+// are served to clients whose server name the files do not cover, the first of
+// them being the default. With certFile and keyFile empty, cfg.TLSConfig alone
+// is used.
+func ServeTLS(cfg Config, certFile, keyFile string, router Router) (*Server, error) {
+	if certFile != "" || keyFile != "" {
+		certs := NewCertReloader()
+		if err := certs.Add(certFile, keyFile); err != nil {
+			return nil, err
+		}
+		cfg.TLSConfig = certs.TLSConfig(cfg.TLSConfig)
+	}
+
+	if cfg.TLSConfig == nil {
+		return nil, errors.New("server: ServeTLS needs a certificate or a TLSConfig")
+	}
+	return ServeConfig(cfg, router)
+}
+
+// LoadCertPool reads PEM certificates from files into a pool, e.g. the CAs
+// that sign client certificates.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+	return pool, nil
+}
+
+// CertReloader serves certificates loaded from files, choosing between them by
+// the server name the client asks for (SNI) and reloading them when the files
+// change. The zero value is not usable; create one with NewCertReloader.
+type CertReloader struct {
+	// ReloadInterval is the minimum time between checks of the files for
+	// changes, which happen during handshakes. Defaults to 10s.
+	ReloadInterval time.Duration
+
+	mu        sync.RWMutex
+	pairs     []*certPair
+	lastCheck time.Time
+}
+
+type certPair struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func NewCertReloader() *CertReloader {
+	return &CertReloader{lastCheck: time.Now()}
+}
+
+// Add loads a certificate and key pair. With a config from TLSConfig whose base
+// has no Certificates, the first pair added is the one served to clients whose
+// server name matches none of them.
+func (c *CertReloader) Add(certFile, keyFile string) error {
+	pair := &certPair{certFile: certFile, keyFile: keyFile}
+	if err := pair.load(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pairs = append(c.pairs, pair)
+	return nil
+}
+
+// Reload reloads every pair whose files changed since they were last loaded.
+// A pair that fails to load keeps its previous certificate.
+func (c *CertReloader) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastCheck = time.Now()
+
+	var errs []error
+	for _, pair := range c.pairs {
+		changed, err := pair.changed()
+		if err == nil && changed {
+			err = pair.load()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetCertificate implements tls.Config.GetCertificate, picking the first pair
+// that is valid for the client's hello. If none is, it returns nil and no
+// error, so crypto/tls falls back to the config's Certificates.
+func (c *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate(hello, false)
+}
+
+// certificate picks the pair for hello, or the first pair if none is valid for
+// it and orFirst is set.
+func (c *CertReloader) certificate(hello *tls.ClientHelloInfo, orFirst bool) (*tls.Certificate, error) {
+	c.mu.RLock()
+	due := time.Since(c.lastCheck) >= c.reloadInterval()
+	c.mu.RUnlock()
+
+	if due {
+		if err := c.Reload(); err != nil {
+			log.Printf("Error: could not reload certificates: %v", err)
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.pairs) == 0 {
+		return nil, errors.New("server: no certificates loaded")
+	}
+	for _, pair := range c.pairs {
+		if hello.SupportsCertificate(pair.cert) == nil {
+			return pair.cert, nil
+		}
+	}
+	if orFirst {
+		return c.pairs[0].cert, nil
+	}
+	return nil, nil
+}
+
+// TLSConfig returns a copy of base, or a new config if base is nil, that gets
+// its certificates from c. Server names that none of c's pairs cover are
+// served from base's Certificates, or by c's first pair if base has none.
+func (c *CertReloader) TLSConfig(base *tls.Config) *tls.Config {
+	var cfg *tls.Config
+	if base == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = base.Clone()
+	}
+
+	if len(cfg.Certificates) > 0 {
+		cfg.GetCertificate = c.GetCertificate
+	} else {
+		cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.certificate(hello, true)
+		}
+	}
+	return cfg
+}
+
+func (c *CertReloader) reloadInterval() time.Duration {
+	if c.ReloadInterval > 0 {
+		return c.ReloadInterval
+	}
+	return defaultReloadInterval
+}
+
+func (p *certPair) load() error {
+	modTime, err := p.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", p.certFile, err)
+	}
+
+	p.cert = &cert
+	p.modTime = modTime
+	return nil
+}
+
+func (p *certPair) changed() (bool, error) {
+	modTime, err := p.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	return !modTime.Equal(p.modTime), nil
+}
+
+// latestModTime returns the later modification time of the two files, as a
+// renewal may replace them one at a time.
+func (p *certPair) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{p.certFile, p.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
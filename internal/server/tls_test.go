@@ -0,0 +1,370 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bailey4770/httpfromtcp/internal/request"
+	"github.com/bailey4770/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate for dnsNames and its key to
+// dir, returning the file paths and the parsed certificate.
+func writeTestCert(t *testing.T, dir, name string, dnsNames ...string) (string, string, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile, cert
+}
+
+// tlsClient returns an HTTP client that trusts only certs.
+func tlsClient(certs ...*x509.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+}
+
+// peerCert dials addr over TLS with serverName and returns the certificate the
+// server presented.
+func peerCert(t *testing.T, addr, serverName string) *x509.Certificate {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestServeTLS(t *testing.T) {
+	t.Run("Certificate files and connection state", func(t *testing.T) {
+		certFile, keyFile, cert := writeTestCert(t, t.TempDir(), "server", "localhost")
+
+		s, err := ServeTLS(Config{Addr: "127.0.0.1:0"}, certFile, keyFile, func(req *request.Request) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				body := "plaintext"
+				if req.TLS != nil {
+					body = fmt.Sprintf("%s %s", tls.VersionName(req.TLS.Version), req.TLS.ServerName)
+				}
+				_ = response.Write(w, response.StatusOK, response.GetDefaultHeaders(), []byte(body))
+			}
+		})
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		_, port, err := net.SplitHostPort(s.Addr().String())
+		require.NoError(t, err)
+
+		resp, err := tlsClient(cert).Get("https://localhost:" + port + "/")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, "TLS 1.3 localhost", string(body))
+	})
+
+	t.Run("tls.Config", func(t *testing.T) {
+		certFile, keyFile, cert := writeTestCert(t, t.TempDir(), "server", "localhost")
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+
+		_, addr := startTestServerConfig(t, Config{TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}}}, func(req *request.Request) Handler {
+			return okHandler
+		})
+
+		resp, err := tlsClient(cert).Get("https://" + addr + "/")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Missing certificate", func(t *testing.T) {
+		_, err := ServeTLS(Config{Addr: "127.0.0.1:0"}, "", "", nil)
+		assert.Error(t, err)
+
+		_, err = ServeTLS(Config{Addr: "127.0.0.1:0"}, "missing.crt", "missing.key", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("Plaintext client is rejected", func(t *testing.T) {
+		certFile, keyFile, _ := writeTestCert(t, t.TempDir(), "server", "localhost")
+		s, err := ServeTLS(Config{Addr: "127.0.0.1:0"}, certFile, keyFile, func(req *request.Request) Handler { return okHandler })
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		_, err = http.Get("http://" + s.Addr().String() + "/")
+		assert.Error(t, err)
+	})
+}
+
+func TestCertReloader(t *testing.T) {
+	t.Run("SNI picks certificate", func(t *testing.T) {
+		dir := t.TempDir()
+		certA, keyA, _ := writeTestCert(t, dir, "a", "a.test")
+		certB, keyB, _ := writeTestCert(t, dir, "b", "b.test", "*.b.test")
+
+		certs := NewCertReloader()
+		require.NoError(t, certs.Add(certA, keyA))
+		require.NoError(t, certs.Add(certB, keyB))
+
+		_, addr := startTestServerConfig(t, Config{TLSConfig: certs.TLSConfig(nil)}, func(req *request.Request) Handler { return okHandler })
+
+		assert.Equal(t, "a.test", peerCert(t, addr, "a.test").Subject.CommonName)
+		assert.Equal(t, "b.test", peerCert(t, addr, "b.test").Subject.CommonName)
+		assert.Equal(t, "b.test", peerCert(t, addr, "www.b.test").Subject.CommonName)
+		// Unknown names get the first certificate
+		assert.Equal(t, "a.test", peerCert(t, addr, "other.test").Subject.CommonName)
+	})
+
+	t.Run("SNI across files and TLSConfig.Certificates", func(t *testing.T) {
+		dir := t.TempDir()
+		certA, keyA, _ := writeTestCert(t, dir, "a", "a.test")
+		certB, keyB, _ := writeTestCert(t, dir, "b", "b.test")
+		certC, keyC, _ := writeTestCert(t, dir, "c", "c.test")
+
+		certs := NewCertReloader()
+		require.NoError(t, certs.Add(certA, keyA))
+
+		pairB, err := tls.LoadX509KeyPair(certB, keyB)
+		require.NoError(t, err)
+		pairC, err := tls.LoadX509KeyPair(certC, keyC)
+		require.NoError(t, err)
+		base := &tls.Config{Certificates: []tls.Certificate{pairB, pairC}}
+
+		_, addr := startTestServerConfig(t, Config{TLSConfig: certs.TLSConfig(base)}, func(req *request.Request) Handler { return okHandler })
+
+		assert.Equal(t, "a.test", peerCert(t, addr, "a.test").Subject.CommonName)
+		assert.Equal(t, "b.test", peerCert(t, addr, "b.test").Subject.CommonName)
+		assert.Equal(t, "c.test", peerCert(t, addr, "c.test").Subject.CommonName)
+		// Unknown names get the config's first certificate
+		assert.Equal(t, "b.test", peerCert(t, addr, "other.test").Subject.CommonName)
+
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "c.test"})
+		require.NoError(t, err)
+		assert.Nil(t, cert)
+	})
+
+	t.Run("Reloads changed files", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile, _ := writeTestCert(t, dir, "server", "old.test")
+
+		certs := NewCertReloader()
+		certs.ReloadInterval = time.Millisecond
+		require.NoError(t, certs.Add(certFile, keyFile))
+		_, addr := startTestServerConfig(t, Config{TLSConfig: certs.TLSConfig(nil)}, func(req *request.Request) Handler { return okHandler })
+
+		assert.Equal(t, "old.test", peerCert(t, addr, "").Subject.CommonName)
+
+		writeTestCert(t, dir, "server", "new.test")
+		// Make sure the change shows even on coarse filesystem timestamps
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, later, later))
+		time.Sleep(5 * time.Millisecond)
+
+		assert.Equal(t, "new.test", peerCert(t, addr, "").Subject.CommonName)
+	})
+
+	t.Run("Broken files keep the old certificate", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile, _ := writeTestCert(t, dir, "server", "old.test")
+
+		certs := NewCertReloader()
+		require.NoError(t, certs.Add(certFile, keyFile))
+
+		require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, later, later))
+		assert.Error(t, certs.Reload())
+
+		cert, err := certs.TLSConfig(nil).GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		assert.Equal(t, "old.test", cert.Leaf.Subject.CommonName)
+	})
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	serverCertFile, serverKeyFile, serverCert := writeTestCert(t, dir, "server", "localhost")
+	clientCertFile, clientKeyFile, _ := writeTestCert(t, dir, "client", "svc-a", "svc-a.internal")
+	otherCertFile, otherKeyFile, _ := writeTestCert(t, dir, "other", "svc-b")
+	untrustedCertFile, untrustedKeyFile, _ := writeTestCert(t, dir, "untrusted", "svc-a")
+
+	// The test certificates are self-signed, so each trusted one is its own CA
+	clientCAs, err := LoadCertPool(clientCertFile, otherCertFile)
+	require.NoError(t, err)
+
+	// client returns an HTTPS client presenting the certificate in the given
+	// files, or none if they are empty.
+	client := func(certFile, keyFile string) *http.Client {
+		c := tlsClient(serverCert)
+		if certFile != "" {
+			pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+			require.NoError(t, err)
+			c.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{pair}
+		}
+		return c
+	}
+
+	identityHandler := func(w *response.Writer, req *request.Request) {
+		body := "anonymous"
+		if cert := req.ClientCertificate(); cert != nil {
+			body = fmt.Sprint(req.ClientIdentities())
+		}
+		_ = response.Write(w, response.StatusOK, response.GetDefaultHeaders(), []byte(body))
+	}
+
+	serve := func(mode ClientCertMode, router Router) string {
+		s, err := ServeTLS(Config{Addr: "127.0.0.1:0", ClientCertMode: mode, ClientCAs: clientCAs}, serverCertFile, serverKeyFile, router)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close() })
+
+		_, port, err := net.SplitHostPort(s.Addr().String())
+		require.NoError(t, err)
+		return "https://localhost:" + port
+	}
+
+	get := func(c *http.Client, url string) (int, string, error) {
+		resp, err := c.Get(url)
+		if err != nil {
+			return 0, "", err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+
+	t.Run("Required client certificate", func(t *testing.T) {
+		url := serve(RequireClientCert, func(req *request.Request) Handler { return identityHandler })
+
+		_, body, err := get(client(clientCertFile, clientKeyFile), url)
+		require.NoError(t, err)
+		assert.Equal(t, "[svc-a svc-a svc-a.internal 127.0.0.1]", body)
+
+		_, _, err = get(client("", ""), url)
+		assert.Error(t, err)
+
+		_, _, err = get(client(untrustedCertFile, untrustedKeyFile), url)
+		assert.Error(t, err)
+	})
+
+	t.Run("Requested client certificate", func(t *testing.T) {
+		url := serve(RequestClientCert, func(req *request.Request) Handler { return identityHandler })
+
+		_, body, err := get(client("", ""), url)
+		require.NoError(t, err)
+		assert.Equal(t, "anonymous", body)
+
+		_, body, err = get(client(otherCertFile, otherKeyFile), url)
+		require.NoError(t, err)
+		assert.Equal(t, "[svc-b svc-b 127.0.0.1]", body)
+
+		_, _, err = get(client(untrustedCertFile, untrustedKeyFile), url)
+		assert.Error(t, err)
+	})
+
+	t.Run("AuthorizeClients", func(t *testing.T) {
+		mux := NewMux()
+		mux.Handle("/orders/{id}", okHandler)
+		mux.Handle("/admin", okHandler)
+		mux.Handle("/health", okHandler)
+		mux.Use(AuthorizeClients(map[string][]string{
+			"svc-a.internal": {"GET /orders/{id}"},
+			"svc-b":          {"/admin"},
+			AnyClient:        {"GET /health"},
+		}))
+		url := serve(RequestClientCert, mux.Route)
+
+		tests := []struct {
+			name   string
+			client *http.Client
+			path   string
+			want   int
+		}{
+			{"Allowed by SAN", client(clientCertFile, clientKeyFile), "/orders/1", http.StatusOK},
+			{"Route not allowed", client(clientCertFile, clientKeyFile), "/admin", http.StatusForbidden},
+			{"Allowed by CN", client(otherCertFile, otherKeyFile), "/admin", http.StatusOK},
+			{"Any verified client", client(otherCertFile, otherKeyFile), "/health", http.StatusOK},
+			{"No certificate", client("", ""), "/health", http.StatusForbidden},
+		}
+		for _, tc := range tests {
+			status, _, err := get(tc.client, url+tc.path)
+			require.NoError(t, err, tc.name)
+			assert.Equal(t, tc.want, status, tc.name)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, url+"/orders/1", nil)
+		require.NoError(t, err)
+		resp, err := client(clientCertFile, clientKeyFile).Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("Invalid config", func(t *testing.T) {
+		_, err := ServeConfig(Config{Addr: "127.0.0.1:0", ClientCertMode: RequireClientCert, ClientCAs: clientCAs}, nil)
+		assert.Error(t, err)
+
+		_, err = ServeTLS(Config{Addr: "127.0.0.1:0", ClientCertMode: RequireClientCert}, serverCertFile, serverKeyFile, nil)
+		assert.Error(t, err)
+
+		// Without ClientCAs crypto/tls would verify clients against the system roots
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer func() { _ = l.Close() }()
+		pair, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+		require.NoError(t, err)
+		_, err = ServeListener(l, Config{TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}}, ClientCertMode: RequireClientCert}, nil)
+		assert.Error(t, err)
+
+		assert.Panics(t, func() { AuthorizeClients(map[string][]string{"svc-a": {"bad pattern"}}) })
+	})
+}